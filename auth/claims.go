@@ -0,0 +1,61 @@
+// Package auth holds the token format and signing keys shared by the
+// web-server, which issues tokens, and the websocket-server, which verifies them.
+package auth
+
+import (
+	"errors"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims are carried by every access token
+type Claims struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	// Role is the user's role when the token was issued; changes apply from
+	// the next refresh
+	Role string `json:"role,omitempty"`
+	// SessionID names the login session the token was issued for, so revoking
+	// the session cuts off every token and socket that belongs to it
+	SessionID string `json:"sid,omitempty"`
+	// Purpose marks single-use tokens such as email verification links; only
+	// tokens without a purpose are access tokens
+	Purpose string `json:"purpose,omitempty"`
+	jwt.RegisteredClaims
+}
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrUnknownKey   = errors.New("unknown signing key")
+)
+
+// IsAccessToken reports whether the token may be used to call the API
+func (c *Claims) IsAccessToken() bool {
+	return c.Purpose == ""
+}
+
+// Verifier validates access tokens; implemented by KeySet and RemoteKeySet
+type Verifier interface {
+	Parse(tokenString string) (*Claims, error)
+}
+
+// validMethods lists the algorithms accepted when verifying; HMAC is deliberately
+// excluded so a public key can never be used as a shared secret
+var validMethods = []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+
+func parse(tokenString string, keyfunc jwt.Keyfunc) (*Claims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, keyfunc, jwt.WithValidMethods(validMethods))
+	if err != nil {
+		if errors.Is(err, ErrUnknownKey) {
+			return nil, ErrUnknownKey
+		}
+		return nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(*Claims)
+	if !ok || !token.Valid {
+		return nil, ErrInvalidToken
+	}
+	return claims, nil
+}
@@ -0,0 +1,178 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// JWK is a public key in JSON Web Key format (RFC 7517)
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+
+	// Ed25519 (RFC 8037)
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+var b64 = base64.RawURLEncoding
+
+func toJWK(key *Key) (JWK, error) {
+	jwk := JWK{Kid: key.ID, Use: "sig", Alg: key.Algorithm}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = b64.EncodeToString(pub.N.Bytes())
+		jwk.E = b64.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = b64.EncodeToString(pub)
+	default:
+		return jwk, fmt.Errorf("key %s: unsupported public key type %T", key.ID, key.Public)
+	}
+	return jwk, nil
+}
+
+func fromJWK(jwk JWK) (*Key, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := b64.DecodeString(jwk.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := b64.DecodeString(jwk.E)
+		if err != nil {
+			return nil, err
+		}
+		pub := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return &Key{ID: jwk.Kid, Algorithm: AlgRS256, Public: pub}, nil
+	case "OKP":
+		if jwk.Crv != "Ed25519" {
+			return nil, fmt.Errorf("key %s: unsupported curve %q", jwk.Kid, jwk.Crv)
+		}
+		x, err := b64.DecodeString(jwk.X)
+		if err != nil {
+			return nil, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("key %s: invalid Ed25519 key size", jwk.Kid)
+		}
+		return &Key{ID: jwk.Kid, Algorithm: AlgEdDSA, Public: ed25519.PublicKey(x)}, nil
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %q", jwk.Kid, jwk.Kty)
+	}
+}
+
+// RemoteKeySet verifies tokens with keys fetched from a JWKS endpoint. It
+// refetches when it meets an unknown kid, so keys rotated in by the issuer are
+// picked up without a restart.
+type RemoteKeySet struct {
+	url    string
+	client *http.Client
+
+	// minRefresh rate-limits refetches triggered by unknown kids
+	minRefresh time.Duration
+
+	mu          sync.RWMutex
+	keys        map[string]*Key
+	lastFetched time.Time
+}
+
+func NewRemoteKeySet(url string) *RemoteKeySet {
+	return &RemoteKeySet{
+		url:        url,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		minRefresh: 30 * time.Second,
+		keys:       make(map[string]*Key),
+	}
+}
+
+// Parse verifies a token, refreshing the key set first if its kid is unknown
+func (r *RemoteKeySet) Parse(tokenString string) (*Claims, error) {
+	claims, err := parse(tokenString, r.keyfunc)
+	if !errors.Is(err, ErrUnknownKey) {
+		return claims, err
+	}
+
+	if err := r.Refresh(false); err != nil {
+		return nil, err
+	}
+	claims, err = parse(tokenString, r.keyfunc)
+	if errors.Is(err, ErrUnknownKey) {
+		return nil, ErrInvalidToken
+	}
+	return claims, err
+}
+
+func (r *RemoteKeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	r.mu.RLock()
+	key := r.keys[kid]
+	r.mu.RUnlock()
+
+	return verificationKey(key, token)
+}
+
+// Refresh fetches the JWKS; unless force is set it does nothing if the last
+// fetch was less than minRefresh ago
+func (r *RemoteKeySet) Refresh(force bool) error {
+	r.mu.RLock()
+	recent := time.Since(r.lastFetched) < r.minRefresh
+	r.mu.RUnlock()
+	if recent && !force {
+		return nil
+	}
+
+	resp, err := r.client.Get(r.url)
+	if err != nil {
+		return fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("JWKS endpoint returned status %d", resp.StatusCode)
+	}
+
+	var set JWKS
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return fmt.Errorf("failed to decode JWKS: %v", err)
+	}
+
+	keys := make(map[string]*Key, len(set.Keys))
+	for _, jwk := range set.Keys {
+		key, err := fromJWK(jwk)
+		if err != nil {
+			continue
+		}
+		keys[key.ID] = key
+	}
+
+	r.mu.Lock()
+	r.keys = keys
+	r.lastFetched = time.Now()
+	r.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,246 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	AlgRS256 = "RS256"
+	AlgEdDSA = "EdDSA"
+)
+
+var ErrNoKeys = errors.New("no signing keys found")
+
+// Key is one signing key, identified by the kid header of the tokens it signs.
+// Verify-only keys have no private half.
+type Key struct {
+	ID        string
+	Algorithm string
+	Private   crypto.Signer
+	Public    crypto.PublicKey
+}
+
+func newKey(id string, parsed interface{}) (*Key, error) {
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		return &Key{ID: id, Algorithm: AlgRS256, Private: k, Public: &k.PublicKey}, nil
+	case ed25519.PrivateKey:
+		return &Key{ID: id, Algorithm: AlgEdDSA, Private: k, Public: k.Public()}, nil
+	case *rsa.PublicKey:
+		return &Key{ID: id, Algorithm: AlgRS256, Public: k}, nil
+	case ed25519.PublicKey:
+		return &Key{ID: id, Algorithm: AlgEdDSA, Public: k}, nil
+	default:
+		return nil, fmt.Errorf("key %s: unsupported key type %T", id, parsed)
+	}
+}
+
+func (k *Key) signingMethod() jwt.SigningMethod {
+	if k.Algorithm == AlgRS256 {
+		return jwt.SigningMethodRS256
+	}
+	return jwt.SigningMethodEdDSA
+}
+
+// KeySet holds every key that may have signed a live token plus the active key
+// used for new tokens. Rotating means adding a key and making it active while
+// the previous one stays in the set until its tokens have expired.
+type KeySet struct {
+	mu       sync.RWMutex
+	keys     map[string]*Key
+	activeID string
+}
+
+// LoadKeySet reads every <kid>.pem file in dir. Files may hold a PKCS#8 RSA or
+// Ed25519 private key, or a PKIX public key for verify-only sets. activeID picks
+// the signing key; when empty the private key with the greatest kid is used.
+func LoadKeySet(dir, activeID string) (*KeySet, error) {
+	ks := &KeySet{}
+	if err := ks.LoadDir(dir, activeID); err != nil {
+		return nil, err
+	}
+	return ks, nil
+}
+
+// LoadDir replaces the keys in the set with those in dir, e.g. on SIGHUP after a rotation
+func (ks *KeySet) LoadDir(dir, activeID string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return err
+	}
+	sort.Strings(paths)
+
+	keys := make(map[string]*Key)
+	var greatest string
+	for _, path := range paths {
+		key, err := readKeyFile(path)
+		if err != nil {
+			return err
+		}
+		keys[key.ID] = key
+		if key.Private != nil && key.ID > greatest {
+			greatest = key.ID
+		}
+	}
+	if len(keys) == 0 {
+		return ErrNoKeys
+	}
+	if activeID == "" {
+		activeID = greatest
+	}
+
+	if activeID != "" {
+		if key, ok := keys[activeID]; !ok || key.Private == nil {
+			return fmt.Errorf("active key %q not found or has no private key", activeID)
+		}
+	}
+
+	ks.mu.Lock()
+	ks.keys = keys
+	ks.activeID = activeID
+	ks.mu.Unlock()
+	return nil
+}
+
+func readKeyFile(path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	id := strings.TrimSuffix(filepath.Base(path), ".pem")
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("key %s: no PEM data", id)
+	}
+
+	var parsed interface{}
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("key %s: unsupported PEM block %q", id, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("key %s: %v", id, err)
+	}
+
+	return newKey(id, parsed)
+}
+
+// GenerateKeyFile creates a new private key in dir named after the current date
+// and returns its kid
+func GenerateKeyFile(dir, algorithm string) (string, error) {
+	var private interface{}
+	switch algorithm {
+	case AlgRS256:
+		key, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return "", err
+		}
+		private = key
+	case AlgEdDSA:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return "", err
+		}
+		private = key
+	default:
+		return "", fmt.Errorf("unsupported algorithm %q", algorithm)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	id := time.Now().UTC().Format("20060102T150405Z")
+	path := filepath.Join(dir, id+".pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// Sign issues a token with the active key, setting the kid header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	ks.mu.RLock()
+	key := ks.keys[ks.activeID]
+	ks.mu.RUnlock()
+
+	if key == nil || key.Private == nil {
+		return "", errors.New("no active signing key")
+	}
+
+	token := jwt.NewWithClaims(key.signingMethod(), claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// Parse verifies a token against the key named by its kid header
+func (ks *KeySet) Parse(tokenString string) (*Claims, error) {
+	return parse(tokenString, ks.keyfunc)
+}
+
+func (ks *KeySet) keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	ks.mu.RLock()
+	key := ks.keys[kid]
+	ks.mu.RUnlock()
+
+	return verificationKey(key, token)
+}
+
+func verificationKey(key *Key, token *jwt.Token) (interface{}, error) {
+	if key == nil {
+		return nil, ErrUnknownKey
+	}
+	if token.Method.Alg() != key.Algorithm {
+		return nil, fmt.Errorf("key %s does not sign with %s", key.ID, token.Method.Alg())
+	}
+	return key.Public, nil
+}
+
+// JWKS returns the public half of every key in the set
+func (ks *KeySet) JWKS() JWKS {
+	ks.mu.RLock()
+	defer ks.mu.RUnlock()
+
+	ids := make([]string, 0, len(ks.keys))
+	for id := range ks.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	set := JWKS{Keys: []JWK{}}
+	for _, id := range ids {
+		if jwk, err := toJWK(ks.keys[id]); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
@@ -0,0 +1,172 @@
+package auth
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testClaims() *Claims {
+	return &Claims{
+		UserID:   7,
+		Username: "jane",
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+		},
+	}
+}
+
+// writeKey generates a key under a fixed kid so tests control rotation order
+func writeKey(t *testing.T, dir, kid, algorithm string) {
+	t.Helper()
+	tmp := t.TempDir()
+	id, err := GenerateKeyFile(tmp, algorithm)
+	if err != nil {
+		t.Fatalf("GenerateKeyFile(%s): %v", algorithm, err)
+	}
+	if err := os.Rename(filepath.Join(tmp, id+".pem"), filepath.Join(dir, kid+".pem")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestKeySetSignAndParse(t *testing.T) {
+	for _, alg := range []string{AlgEdDSA, AlgRS256} {
+		t.Run(alg, func(t *testing.T) {
+			dir := t.TempDir()
+			writeKey(t, dir, "k1", alg)
+
+			ks, err := LoadKeySet(dir, "")
+			if err != nil {
+				t.Fatalf("LoadKeySet: %v", err)
+			}
+
+			token, err := ks.Sign(testClaims())
+			if err != nil {
+				t.Fatalf("Sign: %v", err)
+			}
+
+			claims, err := ks.Parse(token)
+			if err != nil {
+				t.Fatalf("Parse: %v", err)
+			}
+			if claims.UserID != 7 || claims.Username != "jane" {
+				t.Errorf("unexpected claims %+v", claims)
+			}
+		})
+	}
+}
+
+func TestKeySetRotationKeepsOldTokensValid(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2024-01", AlgEdDSA)
+
+	ks, err := LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldToken, _ := ks.Sign(testClaims())
+
+	writeKey(t, dir, "2024-02", AlgRS256)
+	if err := ks.LoadDir(dir, "2024-02"); err != nil {
+		t.Fatal(err)
+	}
+	newToken, _ := ks.Sign(testClaims())
+
+	for name, token := range map[string]string{"old": oldToken, "new": newToken} {
+		if _, err := ks.Parse(token); err != nil {
+			t.Errorf("%s token rejected after rotation: %v", name, err)
+		}
+	}
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(newToken, &Claims{})
+	if parsed.Header["kid"] != "2024-02" {
+		t.Errorf("expected new tokens to use kid 2024-02, got %v", parsed.Header["kid"])
+	}
+}
+
+func TestKeySetDefaultsToGreatestKid(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "2024-01", AlgEdDSA)
+
+	ks, err := LoadKeySet(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A new key plus a reload without JWT_ACTIVE_KID rotates to it
+	writeKey(t, dir, "2024-02", AlgRS256)
+	if err := ks.LoadDir(dir, ""); err != nil {
+		t.Fatal(err)
+	}
+	token, _ := ks.Sign(testClaims())
+
+	parsed, _, _ := jwt.NewParser().ParseUnverified(token, &Claims{})
+	if parsed.Header["kid"] != "2024-02" {
+		t.Errorf("expected the greatest kid 2024-02 to sign, got %v", parsed.Header["kid"])
+	}
+}
+
+func TestKeySetRejectsForeignTokens(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "k1", AlgEdDSA)
+	ks, _ := LoadKeySet(dir, "")
+
+	otherDir := t.TempDir()
+	writeKey(t, otherDir, "k1", AlgEdDSA)
+	other, _ := LoadKeySet(otherDir, "")
+	forged, _ := other.Sign(testClaims())
+
+	hmacToken := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	hmacToken.Header["kid"] = "k1"
+	hmacSigned, _ := hmacToken.SignedString([]byte("secret"))
+
+	tests := []struct {
+		name  string
+		token string
+	}{
+		{"Signed By Another Key With Same Kid", forged},
+		{"HMAC Signed", hmacSigned},
+		{"Garbage", "not-a-token"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := ks.Parse(tt.token); err == nil {
+				t.Error("expected token to be rejected")
+			}
+		})
+	}
+}
+
+func TestRemoteKeySetPicksUpRotatedKeys(t *testing.T) {
+	dir := t.TempDir()
+	writeKey(t, dir, "a", AlgEdDSA)
+	ks, _ := LoadKeySet(dir, "")
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(ks.JWKS())
+	}))
+	defer server.Close()
+
+	remote := NewRemoteKeySet(server.URL)
+	remote.minRefresh = 0
+
+	token, _ := ks.Sign(testClaims())
+	if _, err := remote.Parse(token); err != nil {
+		t.Fatalf("Parse with initial key: %v", err)
+	}
+
+	writeKey(t, dir, "b", AlgRS256)
+	if err := ks.LoadDir(dir, "b"); err != nil {
+		t.Fatal(err)
+	}
+	rotated, _ := ks.Sign(testClaims())
+	if _, err := remote.Parse(rotated); err != nil {
+		t.Fatalf("Parse with rotated key: %v", err)
+	}
+}
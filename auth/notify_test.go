@@ -0,0 +1,63 @@
+package auth
+
+import (
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotifyAuthenticatorVerify(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	secret := []byte("shared-secret")
+	body := []byte(`{"type":"new_message"}`)
+	fresh := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-10*time.Minute).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		timestamp string
+		nonce     string
+		signature string
+		body      []byte
+		expected  error
+	}{
+		{"Valid Request", fresh, "n1", SignNotification(secret, fresh, "n1", body), body, nil},
+		{"Missing Signature", fresh, "n2", "", body, ErrMissingSignature},
+		{"Wrong Secret", fresh, "n3", SignNotification([]byte("other"), fresh, "n3", body), body, ErrBadSignature},
+		{"Tampered Body", fresh, "n4", SignNotification(secret, fresh, "n4", body), []byte(`{"type":"evil"}`), ErrBadSignature},
+		{"Stale Timestamp", stale, "n5", SignNotification(secret, stale, "n5", body), body, ErrStaleRequest},
+		{"Replayed Nonce", fresh, "n1", SignNotification(secret, fresh, "n1", body), body, ErrReplayedRequest},
+	}
+
+	verifier := NewNotifyAuthenticator(string(secret))
+	verifier.now = func() time.Time { return now }
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifier.Verify(tt.timestamp, tt.nonce, tt.signature, tt.body)
+			if err != tt.expected {
+				t.Errorf("Verify() = %v, want %v", err, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSignRequestVerifies(t *testing.T) {
+	secret := []byte("shared-secret")
+	body := []byte(`{"type":"new_message"}`)
+
+	req, err := http.NewRequest(http.MethodPost, "http://websocket-server/notify", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SignRequest(req, secret, body); err != nil {
+		t.Fatal(err)
+	}
+
+	verifier := NewNotifyAuthenticator(string(secret))
+	err = verifier.Verify(req.Header.Get(TimestampHeader), req.Header.Get(NonceHeader), req.Header.Get(SignatureHeader), body)
+	if err != nil {
+		t.Errorf("Verify() of a signed request = %v, want nil", err)
+	}
+}
@@ -0,0 +1,37 @@
+package auth
+
+// Roles a user can hold, from least to most privileged
+const (
+	RoleUser      = "user"
+	RoleModerator = "moderator"
+	RoleAdmin     = "admin"
+)
+
+var roleRank = map[string]int{
+	RoleUser:      1,
+	RoleModerator: 2,
+	RoleAdmin:     3,
+}
+
+// ValidRole reports whether role is one of the known roles
+func ValidRole(role string) bool {
+	return roleRank[role] > 0
+}
+
+// RoleAtLeast reports whether role grants everything min does. Tokens issued
+// before roles existed carry no role and count as RoleUser.
+func RoleAtLeast(role, min string) bool {
+	if role == "" {
+		role = RoleUser
+	}
+	return ValidRole(min) && roleRank[role] >= roleRank[min]
+}
+
+// Outranks reports whether role is strictly more privileged than other, as
+// required to moderate another account
+func Outranks(role, other string) bool {
+	if other == "" {
+		other = RoleUser
+	}
+	return roleRank[role] > roleRank[other]
+}
@@ -0,0 +1,35 @@
+package auth
+
+import "testing"
+
+func TestRoleAtLeast(t *testing.T) {
+	tests := []struct {
+		role, min string
+		want      bool
+	}{
+		{RoleAdmin, RoleModerator, true},
+		{RoleModerator, RoleModerator, true},
+		{RoleUser, RoleModerator, false},
+		{"", RoleUser, true},
+		{"", RoleModerator, false},
+		{"superuser", RoleUser, false},
+		{RoleAdmin, "superuser", false},
+	}
+	for _, tt := range tests {
+		if got := RoleAtLeast(tt.role, tt.min); got != tt.want {
+			t.Errorf("RoleAtLeast(%q, %q) = %v, want %v", tt.role, tt.min, got, tt.want)
+		}
+	}
+}
+
+func TestOutranks(t *testing.T) {
+	if !Outranks(RoleModerator, "") {
+		t.Error("moderator should outrank a user without a role")
+	}
+	if Outranks(RoleModerator, RoleModerator) {
+		t.Error("a role should not outrank itself")
+	}
+	if Outranks(RoleModerator, RoleAdmin) {
+		t.Error("moderator should not outrank admin")
+	}
+}
@@ -4,30 +4,115 @@ CREATE TABLE IF NOT EXISTS users (
     username VARCHAR(50) UNIQUE NOT NULL,
     email VARCHAR(100) UNIQUE NOT NULL,
     password_hash VARCHAR(255) NOT NULL,
+    display_name VARCHAR(100) NULL,
+    bio VARCHAR(500) NULL,
+    status_text VARCHAR(140) NULL,
+    timezone VARCHAR(64) NULL,
+    avatar_url VARCHAR(500) NULL,
+    email_verified_at TIMESTAMP NULL,
+    totp_secret VARCHAR(64) NULL,
+    totp_enabled_at TIMESTAMP NULL,
+    totp_last_step BIGINT NULL,
+    role ENUM('user', 'moderator', 'admin') NOT NULL DEFAULT 'user',
+    suspended_at TIMESTAMP NULL,
+    suspended_reason VARCHAR(255) NULL,
+    is_bot BOOLEAN DEFAULT FALSE,
+    owner_id INT NULL,
+    presence_status ENUM('online', 'away', 'offline') DEFAULT 'offline',
+    last_seen_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
-    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (owner_id) REFERENCES users(id) ON DELETE CASCADE
 );
 
--- Create messages table for direct and broadcast messages
+-- Create conversations table: named group conversations
+CREATE TABLE IF NOT EXISTS conversations (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    created_by INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create conversation_members table: current members of each group; owners manage the group
+CREATE TABLE IF NOT EXISTS conversation_members (
+    conversation_id INT NOT NULL,
+    user_id INT NOT NULL,
+    role ENUM('owner', 'member') NOT NULL DEFAULT 'member',
+    joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (conversation_id, user_id),
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_conversation_members_user (user_id)
+);
+
+-- Create channels table: public topic channels anyone can discover and join
+CREATE TABLE IF NOT EXISTS channels (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    name VARCHAR(50) UNIQUE NOT NULL,
+    description VARCHAR(255) NULL,
+    created_by INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (created_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Create messages table for direct, broadcast, group and channel messages.
+-- Channel messages are stored once and have no message_recipients rows.
 CREATE TABLE IF NOT EXISTS messages (
     id INT AUTO_INCREMENT PRIMARY KEY,
     sender_id INT NOT NULL,
+    conversation_id INT NULL,
+    channel_id INT NULL,
     content TEXT NOT NULL,
-    message_type ENUM('direct', 'broadcast') DEFAULT 'direct',
+    message_type ENUM('direct', 'broadcast', 'group', 'channel') DEFAULT 'direct',
     media_url VARCHAR(500) NULL,
     media_type VARCHAR(50) NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    edited_at TIMESTAMP NULL,
     FOREIGN KEY (sender_id) REFERENCES users(id) ON DELETE CASCADE,
+    FOREIGN KEY (conversation_id) REFERENCES conversations(id) ON DELETE CASCADE,
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
     INDEX idx_sender_created (sender_id, created_at),
+    INDEX idx_conversation_created (conversation_id, created_at),
+    INDEX idx_channel_id (channel_id, id),
     INDEX idx_created (created_at)
 );
 
--- Create message_recipients table for direct messages and broadcast recipients
+-- Create channel_members table: who has joined each channel, and the last message
+-- they have read there (unread counts are messages after it). The read pointer is a
+-- plain ID watermark rather than a foreign key so that deleting the message it
+-- points at does not reset it.
+CREATE TABLE IF NOT EXISTS channel_members (
+    channel_id INT NOT NULL,
+    user_id INT NOT NULL,
+    last_read_message_id INT NULL,
+    joined_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (channel_id, user_id),
+    FOREIGN KEY (channel_id) REFERENCES channels(id) ON DELETE CASCADE,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_channel_members_user (user_id)
+);
+
+-- Create message_revisions table: the content a message had before each edit
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    message_id INT NOT NULL,
+    content TEXT NOT NULL,
+    edited_by INT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
+    FOREIGN KEY (edited_by) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_message_revisions_message (message_id, id)
+);
+
+-- Create message_recipients table: one row per recipient of a direct, broadcast or group message
 CREATE TABLE IF NOT EXISTS message_recipients (
     id INT AUTO_INCREMENT PRIMARY KEY,
     message_id INT NOT NULL,
     recipient_id INT NOT NULL,
     is_read BOOLEAN DEFAULT FALSE,
+    delivered_at TIMESTAMP NULL,
     read_at TIMESTAMP NULL,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
     FOREIGN KEY (message_id) REFERENCES messages(id) ON DELETE CASCADE,
@@ -36,12 +121,128 @@ CREATE TABLE IF NOT EXISTS message_recipients (
     INDEX idx_recipient_created (recipient_id, created_at)
 );
 
--- Insert sample users with bcrypt hashed passwords (password: "password123")
-INSERT INTO users (username, email, password_hash) VALUES 
-('john_doe', 'john@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm'),
-('jane_smith', 'jane@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm'),
-('bob_wilson', 'bob@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm'),
-('alice_brown', 'alice@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm');
+-- Create user_events table: per-user log of WebSocket events, replayed to reconnecting clients.
+-- The id doubles as the event's sequence number. dedupe_key is set for events raised by an
+-- outbox entry, so a redelivered entry does not store or send its events twice.
+CREATE TABLE IF NOT EXISTS user_events (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSON NOT NULL,
+    dedupe_key VARCHAR(100) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    UNIQUE KEY uq_user_events_dedupe (dedupe_key),
+    INDEX idx_user_events_user (user_id, id),
+    INDEX idx_user_events_created (created_at)
+);
+
+-- Create outbox table: WebSocket notifications written in the same transaction as the
+-- change they describe and delivered by the web-server's dispatcher with retries
+CREATE TABLE IF NOT EXISTS outbox (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    event_type VARCHAR(50) NOT NULL,
+    payload JSON NOT NULL,
+    status ENUM('pending', 'delivered', 'dead') DEFAULT 'pending',
+    attempts INT DEFAULT 0,
+    last_error TEXT NULL,
+    next_attempt_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    -- Set once the entry no longer holds back the entries after it
+    parked_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_at TIMESTAMP NULL,
+    INDEX idx_outbox_status_next (status, next_attempt_at)
+);
+
+-- Create sessions table: one row per refresh token, stored as a SHA-256 hash.
+-- Rotating a refresh token marks its row rotated and inserts a new row with the same
+-- family_id, which is the session ID carried in access tokens.
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    family_id CHAR(32) NOT NULL,
+    user_id INT NOT NULL,
+    refresh_token_hash CHAR(64) NOT NULL UNIQUE,
+    user_agent VARCHAR(255) NULL,
+    ip_address VARCHAR(45) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP NULL,
+    revoked_at TIMESTAMP NULL,
+    revoked_reason VARCHAR(50) NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_sessions_family (family_id),
+    INDEX idx_sessions_user (user_id, revoked_at)
+);
+
+-- Create password_resets table: single-use reset tokens, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS password_resets (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_password_resets_user (user_id, used_at)
+);
+
+-- Create mfa_recovery_codes table: one-time codes for accounts with 2FA, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS mfa_recovery_codes (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    code_hash CHAR(64) NOT NULL,
+    used_at TIMESTAMP NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_mfa_recovery_user (user_id, code_hash)
+);
+
+-- Create auth_audit table: every login attempt, including failed and throttled ones
+CREATE TABLE IF NOT EXISTS auth_audit (
+    id BIGINT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NULL,
+    username VARCHAR(100) NOT NULL,
+    event VARCHAR(30) NOT NULL,
+    ip_address VARCHAR(45) NULL,
+    user_agent VARCHAR(255) NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE SET NULL,
+    INDEX idx_auth_audit_user (user_id, created_at),
+    INDEX idx_auth_audit_ip (ip_address, created_at)
+);
+
+-- Create personal_access_tokens table: scoped API tokens for users and bots, stored as SHA-256 hashes
+CREATE TABLE IF NOT EXISTS personal_access_tokens (
+    id INT AUTO_INCREMENT PRIMARY KEY,
+    user_id INT NOT NULL,
+    name VARCHAR(100) NOT NULL,
+    token_hash CHAR(64) NOT NULL UNIQUE,
+    token_prefix VARCHAR(12) NOT NULL,
+    scopes VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_at TIMESTAMP NULL,
+    expires_at TIMESTAMP NULL,
+    revoked_at TIMESTAMP NULL,
+    FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+    INDEX idx_personal_access_tokens_user (user_id, revoked_at)
+);
+
+-- Create app_settings table: runtime policy changed by admins, read by both servers
+CREATE TABLE IF NOT EXISTS app_settings (
+    name VARCHAR(64) PRIMARY KEY,
+    value VARCHAR(255) NOT NULL,
+    updated_by INT NULL,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP ON UPDATE CURRENT_TIMESTAMP,
+    FOREIGN KEY (updated_by) REFERENCES users(id) ON DELETE SET NULL
+);
+
+-- Insert sample users with bcrypt hashed passwords (password: "password123"), already verified.
+-- john_doe is an admin and bob_wilson a moderator.
+INSERT INTO users (username, email, password_hash, email_verified_at, role) VALUES 
+('john_doe', 'john@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm', CURRENT_TIMESTAMP, 'admin'),
+('jane_smith', 'jane@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm', CURRENT_TIMESTAMP, 'user'),
+('bob_wilson', 'bob@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm', CURRENT_TIMESTAMP, 'moderator'),
+('alice_brown', 'alice@example.com', '$2a$10$rVmq6G7tQXNOJR5Zr5rGH.yDGjLqXQE3RjKx6zXOQ4yKJ5VGQz5Vm', CURRENT_TIMESTAMP, 'user');
 
 -- Insert sample direct messages
 INSERT INTO messages (sender_id, content, message_type) VALUES 
@@ -65,6 +266,13 @@ INSERT INTO message_recipients (message_id, recipient_id) VALUES
 (4, 2), -- Broadcast to Jane
 (4, 4); -- Broadcast to Alice
 
+-- Insert a default channel everyone has joined
+INSERT INTO channels (name, description, created_by) VALUES
+('general', 'Company-wide announcements and chat', 1);
+
+INSERT INTO channel_members (channel_id, user_id) VALUES
+(1, 1), (1, 2), (1, 3), (1, 4);
+
 
 -- Messages table indexes
 ALTER TABLE messages ADD INDEX idx_message_type (message_type);
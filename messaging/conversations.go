@@ -0,0 +1,245 @@
+package messaging
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Conversation types in ConversationSummary and ConversationKey
+const (
+	ConversationDirect = "direct"
+	ConversationGroup  = "group"
+)
+
+// ConversationKey identifies a conversation from one user's point of view:
+// the other user of a direct conversation, or a group
+type ConversationKey struct {
+	Type string `json:"type"`
+	ID   int    `json:"id"`
+}
+
+// ConversationSummary is one entry of a user's conversation list. ID is the
+// other user's ID for direct conversations and the group's ID for groups.
+type ConversationSummary struct {
+	Type           string    `json:"type"`
+	ID             int       `json:"id"`
+	Name           string    `json:"name"`
+	AvatarURL      *string   `json:"avatar_url"`
+	LastMessage    *Message  `json:"last_message"`
+	UnreadCount    int       `json:"unread_count"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	// ActivityID orders conversations last active at the same time: the last
+	// message's ID, or minus the group's ID for a group without messages
+	ActivityID int `json:"-"`
+}
+
+// ConversationKeys returns, per participant, the conversation a direct or
+// group message belongs to. Broadcast and channel messages are not part of
+// any conversation.
+func ConversationKeys(message Message, recipientIDs []int) map[int][]ConversationKey {
+	keys := make(map[int][]ConversationKey)
+	switch {
+	case message.MessageType == "direct":
+		for _, recipientID := range recipientIDs {
+			keys[message.SenderID] = append(keys[message.SenderID], ConversationKey{ConversationDirect, recipientID})
+			keys[recipientID] = append(keys[recipientID], ConversationKey{ConversationDirect, message.SenderID})
+		}
+	case message.MessageType == "group" && message.ConversationID != nil:
+		key := ConversationKey{ConversationGroup, *message.ConversationID}
+		keys[message.SenderID] = []ConversationKey{key}
+		for _, recipientID := range recipientIDs {
+			keys[recipientID] = []ConversationKey{key}
+		}
+	}
+	return keys
+}
+
+// conversationsQuery builds the query behind every conversation listing: the
+// direct and group conversations of userID with their last message ID, unread
+// count, last activity and activity ID. If only is set the query is narrowed
+// to that one conversation, which keeps it cheap enough to run per update.
+func conversationsQuery(userID int, only *ConversationKey) (string, []interface{}) {
+	var parts []string
+	var args []interface{}
+
+	if only == nil || only.Type == ConversationDirect {
+		// Direct messages between the user and anyone, or only the partner
+		participants := "(m.sender_id = ? OR mr.recipient_id = ?)"
+		participantArgs := []interface{}{userID, userID}
+		if only != nil {
+			participants = "((m.sender_id = ? AND mr.recipient_id = ?) OR (m.sender_id = ? AND mr.recipient_id = ?))"
+			participantArgs = []interface{}{userID, only.ID, only.ID, userID}
+		}
+		parts = append(parts, `
+			SELECT 'direct' AS type, d.partner_id AS id, u.username AS name, u.avatar_url,
+			       d.last_message_id,
+			       (SELECT COUNT(*) FROM messages um
+			        JOIN message_recipients umr ON umr.message_id = um.id
+			        WHERE um.message_type = 'direct' AND um.sender_id = d.partner_id
+			          AND umr.recipient_id = ? AND umr.is_read = FALSE) AS unread_count,
+			       lm.created_at AS last_activity_at,
+			       lm.id AS activity_id
+			FROM (
+				SELECT IF(m.sender_id = ?, mr.recipient_id, m.sender_id) AS partner_id, MAX(m.id) AS last_message_id
+				FROM messages m
+				JOIN message_recipients mr ON mr.message_id = m.id
+				WHERE m.message_type = 'direct' AND `+participants+`
+				GROUP BY partner_id
+			) d
+			JOIN users u ON u.id = d.partner_id
+			JOIN messages lm ON lm.id = d.last_message_id`)
+		args = append(args, userID, userID) // unread_count, partner_id
+		args = append(args, participantArgs...)
+	}
+
+	if only == nil || only.Type == ConversationGroup {
+		group := ""
+		if only != nil {
+			group = " WHERE c.id = ?"
+		}
+		parts = append(parts, `
+			SELECT 'group' AS type, c.id AS id, c.name AS name, NULL AS avatar_url,
+			       lm.id AS last_message_id,
+			       (SELECT COUNT(*) FROM messages um
+			        JOIN message_recipients umr ON umr.message_id = um.id
+			        WHERE um.conversation_id = c.id AND umr.recipient_id = ? AND umr.is_read = FALSE) AS unread_count,
+			       COALESCE(lm.created_at, c.created_at) AS last_activity_at,
+			       COALESCE(lm.id, -c.id) AS activity_id
+			FROM conversations c
+			JOIN conversation_members cm ON cm.conversation_id = c.id AND cm.user_id = ?
+			LEFT JOIN messages lm ON lm.id = (SELECT MAX(id) FROM messages WHERE conversation_id = c.id)`+group)
+		args = append(args, userID, userID) // unread_count, membership
+		if only != nil {
+			args = append(args, only.ID)
+		}
+	}
+
+	return strings.Join(parts, "\n\t\t\tUNION ALL"), args
+}
+
+// ListConversations returns up to limit of userID's conversations, most
+// recently active first. Unless beforeAt is zero, the list starts after the
+// conversation last active at beforeAt with ActivityID beforeID.
+func ListConversations(db Queryer, userID int, beforeAt time.Time, beforeID int, limit int) ([]ConversationSummary, error) {
+	query, args := conversationsQuery(userID, nil)
+	query = "SELECT * FROM (" + query + ") x"
+	if !beforeAt.IsZero() {
+		query += " WHERE x.last_activity_at < ? OR (x.last_activity_at = ? AND x.activity_id < ?)"
+		args = append(args, beforeAt, beforeAt, beforeID)
+	}
+	query += " ORDER BY x.last_activity_at DESC, x.activity_id DESC LIMIT ?"
+	args = append(args, limit)
+
+	conversations, err := queryConversations(db, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	all := make([]*ConversationSummary, len(conversations))
+	for i := range conversations {
+		all[i] = &conversations[i]
+	}
+	return conversations, attachLastMessages(db, all)
+}
+
+// LoadConversations returns each user's own view of their given
+// conversations, skipping any they are no longer part of. Every conversation
+// is loaded with a query narrowed to it, and the last messages all at once.
+func LoadConversations(db Queryer, keys map[int][]ConversationKey) (map[int][]ConversationSummary, error) {
+	views := make(map[int][]ConversationSummary, len(keys))
+	for userID, userKeys := range keys {
+		seen := make(map[ConversationKey]bool, len(userKeys))
+		for _, key := range userKeys {
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			query, args := conversationsQuery(userID, &key)
+			conversations, err := queryConversations(db, query, args...)
+			if err != nil {
+				return nil, err
+			}
+			views[userID] = append(views[userID], conversations...)
+		}
+	}
+
+	var all []*ConversationSummary
+	for userID := range views {
+		for i := range views[userID] {
+			all = append(all, &views[userID][i])
+		}
+	}
+	return views, attachLastMessages(db, all)
+}
+
+// queryConversations runs a query over conversationsQuery. The last messages
+// only carry their ID until attachLastMessages loads them.
+func queryConversations(db Queryer, query string, args ...interface{}) ([]ConversationSummary, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	conversations := []ConversationSummary{}
+	for rows.Next() {
+		var conversation ConversationSummary
+		var lastID sql.NullInt64
+		if err := rows.Scan(
+			&conversation.Type, &conversation.ID, &conversation.Name, &conversation.AvatarURL,
+			&lastID, &conversation.UnreadCount, &conversation.LastActivityAt, &conversation.ActivityID,
+		); err != nil {
+			return nil, err
+		}
+		if lastID.Valid {
+			conversation.LastMessage = &Message{ID: int(lastID.Int64)}
+		}
+		conversations = append(conversations, conversation)
+	}
+	return conversations, rows.Err()
+}
+
+// attachLastMessages loads the last messages of the conversations in one query
+func attachLastMessages(db Queryer, conversations []*ConversationSummary) error {
+	var lastIDs []interface{}
+	seen := make(map[int]bool)
+	for _, conversation := range conversations {
+		if last := conversation.LastMessage; last != nil && !seen[last.ID] {
+			seen[last.ID] = true
+			lastIDs = append(lastIDs, last.ID)
+		}
+	}
+	if len(lastIDs) == 0 {
+		return nil
+	}
+
+	rows, err := db.Query(`
+		SELECT `+Columns+`
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.id IN (`+strings.Repeat("?,", len(lastIDs)-1)+`?)
+	`, lastIDs...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	messages := make(map[int]*Message, len(lastIDs))
+	for rows.Next() {
+		message, err := Scan(rows)
+		if err != nil {
+			return err
+		}
+		messages[message.ID] = &message
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, conversation := range conversations {
+		if last := conversation.LastMessage; last != nil && messages[last.ID] != nil {
+			conversation.LastMessage = messages[last.ID]
+		}
+	}
+	return nil
+}
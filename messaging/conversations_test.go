@@ -0,0 +1,52 @@
+package messaging
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestConversationKeys(t *testing.T) {
+	direct := ConversationKeys(Message{SenderID: 1, MessageType: "direct"}, []int{2, 3})
+	want := map[int][]ConversationKey{
+		1: {{ConversationDirect, 2}, {ConversationDirect, 3}},
+		2: {{ConversationDirect, 1}},
+		3: {{ConversationDirect, 1}},
+	}
+	if !reflect.DeepEqual(direct, want) {
+		t.Errorf("direct keys = %v, want %v", direct, want)
+	}
+
+	groupID := 9
+	group := ConversationKeys(Message{SenderID: 1, MessageType: "group", ConversationID: &groupID}, []int{2})
+	want = map[int][]ConversationKey{
+		1: {{ConversationGroup, 9}},
+		2: {{ConversationGroup, 9}},
+	}
+	if !reflect.DeepEqual(group, want) {
+		t.Errorf("group keys = %v, want %v", group, want)
+	}
+
+	for _, messageType := range []string{"broadcast", "channel"} {
+		if keys := ConversationKeys(Message{SenderID: 1, MessageType: messageType}, []int{2}); len(keys) != 0 {
+			t.Errorf("%s message keys = %v, want none", messageType, keys)
+		}
+	}
+}
+
+func TestConversationsQueryArgs(t *testing.T) {
+	for _, only := range []*ConversationKey{nil, {ConversationDirect, 2}, {ConversationGroup, 9}} {
+		query, args := conversationsQuery(1, only)
+		if n := strings.Count(query, "?"); n != len(args) {
+			t.Errorf("conversationsQuery(1, %v) has %d placeholders and %d args", only, n, len(args))
+		}
+	}
+
+	_, args := conversationsQuery(1, &ConversationKey{ConversationGroup, 9})
+	if want := []interface{}{1, 1, 9}; !reflect.DeepEqual(args, want) {
+		t.Errorf("group args = %v, want %v", args, want)
+	}
+	if query, _ := conversationsQuery(1, &ConversationKey{ConversationDirect, 2}); strings.Contains(query, "UNION") {
+		t.Error("a direct conversation query should not include groups")
+	}
+}
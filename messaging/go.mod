@@ -0,0 +1,9 @@
+module chatapp/messaging
+
+go 1.21
+
+require chatapp/auth v0.0.0
+
+require github.com/golang-jwt/jwt/v5 v5.3.0 // indirect
+
+replace chatapp/auth => ../auth
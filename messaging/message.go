@@ -0,0 +1,56 @@
+// Package messaging holds the message rules shared by the web-server and the
+// websocket-server, so a message is checked and stored the same way whether it
+// arrives over the REST API or a socket.
+package messaging
+
+import (
+	"database/sql"
+	"time"
+)
+
+type Message struct {
+	ID             int       `json:"id"`
+	SenderID       int       `json:"sender_id"`
+	Content        string    `json:"content"`
+	MessageType    string    `json:"message_type"`              // "direct", "broadcast", "group" or "channel"
+	ConversationID *int      `json:"conversation_id,omitempty"` // Set for group messages
+	ChannelID      *int      `json:"channel_id,omitempty"`      // Set for channel messages
+	MediaURL       *string   `json:"media_url"`
+	MediaType      *string   `json:"media_type"`
+	CreatedAt      time.Time `json:"created_at"`
+	// EditedAt is set once the sender has edited the message
+	EditedAt *time.Time `json:"edited_at"`
+
+	SenderUsername string `json:"sender_username,omitempty"`
+	// SenderAvatarURL is the sender's avatar thumbnail, nil if they have none
+	SenderAvatarURL *string `json:"sender_avatar_url"`
+}
+
+// Columns are the columns every message query selects, in the order Scan
+// reads them. The message is m and its sender u.
+const Columns = `m.id, m.sender_id, m.content, m.message_type, m.media_url, m.media_type, m.conversation_id, m.channel_id, m.edited_at, m.created_at, u.username, u.avatar_url`
+
+// Queryer is the read side of *sql.DB and *sql.Tx
+type Queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// Scan reads a message selected with Columns
+func Scan(row scanner) (Message, error) {
+	var message Message
+	err := row.Scan(
+		&message.ID, &message.SenderID, &message.Content, &message.MessageType,
+		&message.MediaURL, &message.MediaType, &message.ConversationID, &message.ChannelID, &message.EditedAt, &message.CreatedAt, &message.SenderUsername, &message.SenderAvatarURL,
+	)
+	return message, err
+}
+
+// Load returns one message with its sender's details
+func Load(db Queryer, messageID int) (Message, error) {
+	return Scan(db.QueryRow("SELECT "+Columns+" FROM messages m JOIN users u ON m.sender_id = u.id WHERE m.id = ?", messageID))
+}
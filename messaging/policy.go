@@ -0,0 +1,79 @@
+package messaging
+
+import (
+	"database/sql"
+	"strings"
+
+	"chatapp/auth"
+)
+
+// SettingBroadcastMinRole names the app_settings row holding the least
+// privileged role allowed to send broadcast messages
+const SettingBroadcastMinRole = "broadcast_min_role"
+
+// DefaultBroadcastMinRole applies until an admin sets a broadcast policy. It
+// lets everyone broadcast, as before there was a policy; admins can tighten it.
+const DefaultBroadcastMinRole = auth.RoleUser
+
+// Actions that REQUIRE_VERIFIED_FOR can restrict to verified accounts
+const (
+	ActionBroadcast = "broadcast"
+	ActionMedia     = "media"
+)
+
+// BroadcastMinRole reads the broadcast policy. Both servers read it on every
+// broadcast, so a change applies without a restart.
+func BroadcastMinRole(db Queryer) (string, error) {
+	var role string
+	err := db.QueryRow("SELECT value FROM app_settings WHERE name = ?", SettingBroadcastMinRole).Scan(&role)
+	if err == sql.ErrNoRows || (err == nil && !auth.ValidRole(role)) {
+		return DefaultBroadcastMinRole, nil
+	}
+	return role, err
+}
+
+// CheckBroadcastAllowed returns ErrBroadcastNotAllowed unless the user's
+// current role satisfies the broadcast policy
+func CheckBroadcastAllowed(db Queryer, userID int) error {
+	minRole, err := BroadcastMinRole(db)
+	if err != nil {
+		return err
+	}
+	var role string
+	if err := db.QueryRow("SELECT role FROM users WHERE id = ?", userID).Scan(&role); err != nil {
+		return err
+	}
+	if !auth.RoleAtLeast(role, minRole) {
+		return ErrBroadcastNotAllowed
+	}
+	return nil
+}
+
+// ParseVerifiedOnly reads a REQUIRE_VERIFIED_FOR list such as
+// "broadcast,media" into the set of restricted actions; "none" restricts nothing
+func ParseVerifiedOnly(list string) map[string]bool {
+	actions := make(map[string]bool)
+	for _, action := range strings.Split(list, ",") {
+		if action = strings.TrimSpace(action); action != "" && action != "none" {
+			actions[action] = true
+		}
+	}
+	return actions
+}
+
+// CheckVerified returns ErrEmailNotVerified if the action is in verifiedOnly
+// and the user has not verified their email
+func CheckVerified(db Queryer, verifiedOnly map[string]bool, userID int, action string) error {
+	if !verifiedOnly[action] {
+		return nil
+	}
+	var verified bool
+	err := db.QueryRow("SELECT email_verified_at IS NOT NULL FROM users WHERE id = ?", userID).Scan(&verified)
+	if err != nil {
+		return err
+	}
+	if !verified {
+		return ErrEmailNotVerified
+	}
+	return nil
+}
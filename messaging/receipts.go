@@ -0,0 +1,63 @@
+package messaging
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// Receipts is what MarkRead changed
+type Receipts struct {
+	ReadAt time.Time
+	// BySender holds, per sender, the IDs of the messages that were unread until now
+	BySender map[int][]int
+	// Conversations are the reader's conversations whose unread count changed
+	Conversations []ConversationKey
+}
+
+// MarkRead flags the given messages as read by userID as part of tx. Only
+// messages that were still unread produce receipts, so marking a message
+// read twice notifies its sender once.
+func MarkRead(tx *sql.Tx, userID int, messageIDs []int) (Receipts, error) {
+	receipts := Receipts{ReadAt: time.Now(), BySender: make(map[int][]int)}
+	if len(messageIDs) == 0 {
+		return receipts, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(messageIDs)-1) + "?"
+	args := []interface{}{userID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	rows, err := tx.Query(`
+		SELECT mr.message_id, m.sender_id, m.message_type, m.conversation_id
+		FROM message_recipients mr
+		JOIN messages m ON mr.message_id = m.id
+		WHERE mr.recipient_id = ? AND mr.is_read = false AND mr.message_id IN (`+placeholders+`)
+		FOR UPDATE
+	`, args...)
+	if err != nil {
+		return receipts, err
+	}
+	for rows.Next() {
+		var message Message
+		if err := rows.Scan(&message.ID, &message.SenderID, &message.MessageType, &message.ConversationID); err != nil {
+			rows.Close()
+			return receipts, err
+		}
+		receipts.BySender[message.SenderID] = append(receipts.BySender[message.SenderID], message.ID)
+		receipts.Conversations = append(receipts.Conversations, ConversationKeys(message, []int{userID})[userID]...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return receipts, err
+	}
+
+	// Reading a message implies it was delivered
+	_, err = tx.Exec(`UPDATE message_recipients
+		SET is_read = true, read_at = ?, delivered_at = COALESCE(delivered_at, ?)
+		WHERE recipient_id = ? AND is_read = false AND message_id IN (`+placeholders+`)`,
+		append([]interface{}{receipts.ReadAt, receipts.ReadAt}, args...)...)
+	return receipts, err
+}
@@ -0,0 +1,203 @@
+package messaging
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// SendRequest is a message to send, from POST /api/messages or a
+// send_message frame
+type SendRequest struct {
+	Content     string  `json:"content"`
+	MessageType string  `json:"message_type"`
+	Recipients  []int   `json:"recipients"` // For direct messages
+	MediaURL    *string `json:"media_url"`
+	MediaType   *string `json:"media_type"`
+
+	// ConversationID is the group a "group" message is sent to
+	ConversationID *int `json:"conversation_id"`
+	// ChannelID is the channel a "channel" message is posted in
+	ChannelID *int `json:"channel_id"`
+}
+
+var (
+	ErrContentRequired     = errors.New("Content is required")
+	ErrInvalidMessageType  = errors.New("Invalid message type. Must be 'direct', 'broadcast', 'group' or 'channel'")
+	ErrRecipientsRequired  = errors.New("Recipients required for direct messages")
+	ErrConversationMissing = errors.New("conversation_id required for group messages")
+	ErrNotGroupMember      = errors.New("You are not a member of this group")
+	ErrChannelMissing      = errors.New("channel_id required for channel messages")
+	ErrChannelNotFound     = errors.New("Channel not found")
+	ErrNotChannelMember    = errors.New("Join the channel first")
+	ErrEmailNotVerified    = errors.New("Please verify your email address first")
+	ErrBroadcastNotAllowed = errors.New("You are not allowed to send broadcast messages")
+)
+
+// Rejected reports whether err is one of the Err values above, which explain
+// why a request may not be sent, rather than a database failure
+func Rejected(err error) bool {
+	for _, rejection := range []error{
+		ErrContentRequired, ErrInvalidMessageType, ErrRecipientsRequired, ErrConversationMissing,
+		ErrNotGroupMember, ErrChannelMissing, ErrChannelNotFound, ErrNotChannelMember,
+		ErrEmailNotVerified, ErrBroadcastNotAllowed,
+	} {
+		if errors.Is(err, rejection) {
+			return true
+		}
+	}
+	return false
+}
+
+// Validate checks the request on its own, before it is authorized
+func (req SendRequest) Validate() error {
+	if req.Content == "" {
+		return ErrContentRequired
+	}
+	switch req.MessageType {
+	case "direct", "broadcast", "group", "channel":
+	default:
+		return ErrInvalidMessageType
+	}
+	if req.MessageType == "direct" && len(req.Recipients) == 0 {
+		return ErrRecipientsRequired
+	}
+	if req.MessageType == "group" && req.ConversationID == nil {
+		return ErrConversationMissing
+	}
+	if req.MessageType == "channel" && req.ChannelID == nil {
+		return ErrChannelMissing
+	}
+	return nil
+}
+
+// Authorize checks that senderID may send a validated request: group and
+// channel messages need membership, broadcasts the broadcast policy's role
+// and, if verifiedOnly restricts them, a verified email. Errors other than
+// the Err values above come from the database.
+func Authorize(db Queryer, senderID int, req SendRequest, verifiedOnly map[string]bool) error {
+	switch req.MessageType {
+	case "group":
+		var member bool
+		err := db.QueryRow(
+			"SELECT EXISTS(SELECT 1 FROM conversation_members WHERE conversation_id = ? AND user_id = ?)",
+			*req.ConversationID, senderID,
+		).Scan(&member)
+		if err != nil {
+			return err
+		}
+		if !member {
+			return ErrNotGroupMember
+		}
+	case "channel":
+		var member bool
+		err := db.QueryRow(`
+			SELECT cm.user_id IS NOT NULL
+			FROM channels c
+			LEFT JOIN channel_members cm ON cm.channel_id = c.id AND cm.user_id = ?
+			WHERE c.id = ?
+		`, senderID, *req.ChannelID).Scan(&member)
+		if err == sql.ErrNoRows {
+			return ErrChannelNotFound
+		}
+		if err != nil {
+			return err
+		}
+		if !member {
+			return ErrNotChannelMember
+		}
+	case "broadcast":
+		if err := CheckBroadcastAllowed(db, senderID); err != nil {
+			return err
+		}
+		if err := CheckVerified(db, verifiedOnly, senderID, ActionBroadcast); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send stores an authorized message and its recipients as part of tx. It
+// returns the stored message and the users it should be delivered to; channel
+// messages have none and go to the channel's subscribers instead.
+func Send(tx *sql.Tx, senderID int, req SendRequest) (Message, []int, error) {
+	// Only group messages belong to a conversation, and only channel
+	// messages to a channel
+	if req.MessageType != "group" {
+		req.ConversationID = nil
+	}
+	if req.MessageType != "channel" {
+		req.ChannelID = nil
+	}
+
+	result, err := tx.Exec(
+		"INSERT INTO messages (sender_id, conversation_id, channel_id, content, message_type, media_url, media_type) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		senderID, req.ConversationID, req.ChannelID, req.Content, req.MessageType, req.MediaURL, req.MediaType,
+	)
+	if err != nil {
+		return Message{}, nil, fmt.Errorf("create message: %w", err)
+	}
+	id, _ := result.LastInsertId()
+	messageID := int(id)
+
+	var recipientIDs []int
+	switch req.MessageType {
+	case "direct":
+		for _, recipientID := range req.Recipients {
+			if _, err := tx.Exec(
+				"INSERT INTO message_recipients (message_id, recipient_id) VALUES (?, ?)",
+				messageID, recipientID,
+			); err != nil {
+				return Message{}, nil, fmt.Errorf("add recipient %d: %w", recipientID, err)
+			}
+		}
+		recipientIDs = req.Recipients
+	case "channel":
+		// Stored once for the channel; the sender has read their own message
+		if _, err := tx.Exec(
+			"UPDATE channel_members SET last_read_message_id = ? WHERE channel_id = ? AND user_id = ?",
+			messageID, *req.ChannelID, senderID,
+		); err != nil {
+			return Message{}, nil, fmt.Errorf("update read position in channel %d: %w", *req.ChannelID, err)
+		}
+	default:
+		// Broadcasts reach every user, group messages the group's current members
+		query := "INSERT INTO message_recipients (message_id, recipient_id) SELECT ?, id FROM users WHERE id != ?"
+		args := []interface{}{messageID, senderID}
+		if req.MessageType == "group" {
+			query = "INSERT INTO message_recipients (message_id, recipient_id) SELECT ?, user_id FROM conversation_members WHERE conversation_id = ? AND user_id != ?"
+			args = []interface{}{messageID, *req.ConversationID, senderID}
+		}
+		if _, err := tx.Exec(query, args...); err != nil {
+			return Message{}, nil, fmt.Errorf("add %s recipients: %w", req.MessageType, err)
+		}
+		if recipientIDs, err = Recipients(tx, messageID); err != nil {
+			return Message{}, nil, fmt.Errorf("load %s recipients: %w", req.MessageType, err)
+		}
+	}
+
+	message, err := Load(tx, messageID)
+	if err != nil {
+		return Message{}, nil, fmt.Errorf("load message %d: %w", messageID, err)
+	}
+	return message, recipientIDs, nil
+}
+
+// Recipients returns the IDs of the users a message was sent to
+func Recipients(db Queryer, messageID int) ([]int, error) {
+	rows, err := db.Query("SELECT recipient_id FROM message_recipients WHERE message_id = ?", messageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var recipientIDs []int
+	for rows.Next() {
+		var userID int
+		if err := rows.Scan(&userID); err != nil {
+			return nil, err
+		}
+		recipientIDs = append(recipientIDs, userID)
+	}
+	return recipientIDs, rows.Err()
+}
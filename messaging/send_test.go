@@ -0,0 +1,56 @@
+package messaging
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestSendRequestValidate(t *testing.T) {
+	id := 1
+	tests := []struct {
+		req  SendRequest
+		want error
+	}{
+		{SendRequest{Content: "hi", MessageType: "direct", Recipients: []int{2}}, nil},
+		{SendRequest{Content: "hi", MessageType: "broadcast"}, nil},
+		{SendRequest{Content: "hi", MessageType: "group", ConversationID: &id}, nil},
+		{SendRequest{Content: "hi", MessageType: "channel", ChannelID: &id}, nil},
+		{SendRequest{MessageType: "direct", Recipients: []int{2}}, ErrContentRequired},
+		{SendRequest{Content: "hi", MessageType: "email"}, ErrInvalidMessageType},
+		{SendRequest{Content: "hi", MessageType: "direct"}, ErrRecipientsRequired},
+		{SendRequest{Content: "hi", MessageType: "group"}, ErrConversationMissing},
+		{SendRequest{Content: "hi", MessageType: "channel"}, ErrChannelMissing},
+	}
+	for _, tt := range tests {
+		if got := tt.req.Validate(); got != tt.want {
+			t.Errorf("Validate(%+v) = %v, want %v", tt.req, got, tt.want)
+		}
+	}
+}
+
+func TestParseVerifiedOnly(t *testing.T) {
+	tests := []struct {
+		list string
+		want map[string]bool
+	}{
+		{"broadcast,media", map[string]bool{ActionBroadcast: true, ActionMedia: true}},
+		{" broadcast , ", map[string]bool{ActionBroadcast: true}},
+		{"none", map[string]bool{}},
+		{"", map[string]bool{}},
+	}
+	for _, tt := range tests {
+		if got := ParseVerifiedOnly(tt.list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseVerifiedOnly(%q) = %v, want %v", tt.list, got, tt.want)
+		}
+	}
+}
+
+func TestRejected(t *testing.T) {
+	if !Rejected(ErrNotChannelMember) || !Rejected(ErrBroadcastNotAllowed) {
+		t.Error("send rule errors should count as rejections")
+	}
+	if Rejected(errors.New("connection refused")) || Rejected(nil) {
+		t.Error("other errors should not count as rejections")
+	}
+}
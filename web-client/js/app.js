@@ -1,6 +1,8 @@
 class ChatApp {
     constructor() {
         this.token = localStorage.getItem('token');
+        this.refreshToken = localStorage.getItem('refreshToken');
+        this.refreshing = null;
         this.user = JSON.parse(localStorage.getItem('user') || '{}');
         this.apiBaseUrl = '/api'; // Use relative path, nginx will proxy to backend
         this.selectedUser = null;
@@ -29,6 +31,30 @@ class ChatApp {
             this.toggleAuthMode();
         });
 
+        // Two-factor authentication
+        document.getElementById('mfaForm').addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.handleMfa();
+        });
+
+        document.getElementById('cancelMfa').addEventListener('click', () => {
+            this.hideMfaModal();
+        });
+
+        // Password reset
+        document.getElementById('forgotPassword').addEventListener('click', () => {
+            this.showPasswordModal(null);
+        });
+
+        document.getElementById('backToLogin').addEventListener('click', () => {
+            this.hidePasswordModal();
+        });
+
+        document.getElementById('passwordForm').addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.handlePasswordForm();
+        });
+
         // Main app functionality
         document.getElementById('logoutBtn').addEventListener('click', () => {
             this.logout();
@@ -115,6 +141,23 @@ class ChatApp {
     checkAuth() {
         // Always clear any existing data first
         this.clearAllData();
+
+        // Opened from a verification email
+        const params = new URLSearchParams(window.location.search);
+        const verifyToken = params.get('verify_token');
+        if (verifyToken) {
+            window.history.replaceState({}, '', window.location.pathname);
+            this.verifyEmail(verifyToken);
+        }
+
+        // Opened from a password reset email
+        const resetToken = params.get('reset_token');
+        if (resetToken) {
+            window.history.replaceState({}, '', window.location.pathname);
+            this.showAuthModal();
+            this.showPasswordModal(resetToken);
+            return;
+        }
         
         if (this.token && this.user.id) {
             // Verify token is still valid by making an API call
@@ -157,16 +200,10 @@ class ChatApp {
                 body: JSON.stringify(data)
             });
 
-            if (response.success) {
-                this.token = response.data.token;
-                this.user = response.data.user;
-                localStorage.setItem('token', this.token);
-                localStorage.setItem('user', JSON.stringify(this.user));
-                
-                this.hideAuthModal();
-                this.showChatInterface();
-                this.loadUsers();
-                this.showSuccess(response.message);
+            if (response.success && response.data.mfa_required) {
+                this.showMfaModal(response.data.mfa_token);
+            } else if (response.success) {
+                this.completeLogin(response);
             } else {
                 this.handleFormErrors(response.error || 'Authentication failed');
             }
@@ -239,6 +276,119 @@ class ChatApp {
         document.getElementById('authModal').classList.remove('show');
     }
 
+    completeLogin(response) {
+        this.storeTokens(response.data);
+        this.user = response.data.user;
+        localStorage.setItem('user', JSON.stringify(this.user));
+
+        this.hideAuthModal();
+        this.showChatInterface();
+        this.loadUsers();
+        this.showSuccess(response.message);
+    }
+
+    showMfaModal(mfaToken) {
+        this.mfaToken = mfaToken;
+        document.getElementById('mfaForm').reset();
+        this.hideAuthModal();
+        document.getElementById('mfaModal').classList.add('show');
+        document.getElementById('mfaCode').focus();
+    }
+
+    hideMfaModal() {
+        this.mfaToken = null;
+        document.getElementById('mfaModal').classList.remove('show');
+        document.getElementById('authModal').classList.add('show');
+    }
+
+    async handleMfa() {
+        try {
+            const response = await this.apiCall('/auth/mfa', {
+                method: 'POST',
+                body: JSON.stringify({
+                    mfa_token: this.mfaToken,
+                    code: document.getElementById('mfaCode').value
+                })
+            });
+
+            if (response.success) {
+                this.mfaToken = null;
+                document.getElementById('mfaModal').classList.remove('show');
+                this.completeLogin(response);
+            } else {
+                this.showError(response.error || 'Verification failed');
+            }
+        } catch (error) {
+            console.error('MFA error:', error);
+            this.showError('Unable to connect to the server');
+        }
+    }
+
+    // Without a token the modal asks for an email to send the reset link to;
+    // with one it asks for the new password
+    showPasswordModal(resetToken) {
+        this.resetToken = resetToken;
+        const resetting = Boolean(resetToken);
+
+        document.getElementById('passwordTitle').textContent = resetting ? 'Choose a New Password' : 'Forgot Password';
+        document.getElementById('passwordButton').textContent = resetting ? 'Reset Password' : 'Send Reset Link';
+        document.getElementById('resetEmailField').style.display = resetting ? 'none' : 'block';
+        document.getElementById('resetEmail').required = !resetting;
+        document.getElementById('newPasswordField').style.display = resetting ? 'block' : 'none';
+        document.getElementById('newPassword').required = resetting;
+        document.getElementById('passwordForm').reset();
+
+        this.hideAuthModal();
+        document.getElementById('passwordModal').classList.add('show');
+    }
+
+    hidePasswordModal() {
+        this.resetToken = null;
+        document.getElementById('passwordModal').classList.remove('show');
+        document.getElementById('authModal').classList.add('show');
+    }
+
+    async verifyEmail(token) {
+        try {
+            const response = await this.apiCall('/auth/verify-email', {
+                method: 'POST',
+                body: JSON.stringify({ token })
+            });
+            if (response.success) {
+                this.showSuccess(response.message);
+            } else {
+                this.showError(response.error || 'Email verification failed');
+            }
+        } catch (error) {
+            console.error('Email verification error:', error);
+        }
+    }
+
+    async handlePasswordForm() {
+        const resetting = Boolean(this.resetToken);
+        const endpoint = resetting ? '/auth/reset-password' : '/auth/forgot-password';
+        const data = resetting
+            ? { token: this.resetToken, password: document.getElementById('newPassword').value }
+            : { email: document.getElementById('resetEmail').value };
+
+        try {
+            const response = await this.apiCall(endpoint, {
+                method: 'POST',
+                body: JSON.stringify(data)
+            });
+
+            if (response.success) {
+                this.showSuccess(response.message);
+                this.hidePasswordModal();
+            } else {
+                this.showError(response.error || 'Password reset failed');
+            }
+        } catch (error) {
+            console.error('Password reset error:', error);
+            this.showError('Unable to connect to the server');
+        }
+    }
+
     showChatInterface() {
         this.hideAuthModal();
         document.getElementById('chatContainer').style.display = 'flex';
@@ -252,6 +402,15 @@ class ChatApp {
     }
 
     logout() {
+        // Revoke the session server-side; the local state is cleared either way
+        if (this.refreshToken) {
+            fetch(`${this.apiBaseUrl}/auth/logout`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ refresh_token: this.refreshToken })
+            }).catch(error => console.error('Logout failed:', error));
+        }
+
         this.clearAllData();
         this.disconnectWebSocket();
         
@@ -262,9 +421,11 @@ class ChatApp {
     // Clear all user data and interface
     clearAllData() {
         this.token = null;
+        this.refreshToken = null;
         this.user = {};
         this.selectedUser = null;
         localStorage.removeItem('token');
+        localStorage.removeItem('refreshToken');
         localStorage.removeItem('user');
         
         // Clear interface
@@ -280,15 +441,67 @@ class ChatApp {
         this.showAuthModal();
     }
 
+    storeTokens(data) {
+        this.token = data.token;
+        localStorage.setItem('token', this.token);
+        if (data.refresh_token) {
+            this.refreshToken = data.refresh_token;
+            localStorage.setItem('refreshToken', this.refreshToken);
+        }
+    }
+
+    // Exchange the refresh token for a new access token. Concurrent callers
+    // share one request, since each refresh token can only be used once.
+    refreshSession() {
+        if (!this.refreshToken) {
+            return Promise.resolve(false);
+        }
+        if (!this.refreshing) {
+            this.refreshing = fetch(`${this.apiBaseUrl}/auth/refresh`, {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ refresh_token: this.refreshToken })
+            })
+                .then(response => response.json())
+                .then(result => {
+                    if (!result.success) {
+                        return false;
+                    }
+                    this.storeTokens(result.data);
+                    return true;
+                })
+                .catch(() => false)
+                .finally(() => { this.refreshing = null; });
+        }
+        return this.refreshing;
+    }
+
+    // Refresh the access token if it expires within the next 30 seconds
+    async ensureFreshToken() {
+        try {
+            const payload = JSON.parse(atob(this.token.split('.')[1].replace(/-/g, '+').replace(/_/g, '/')));
+            if (payload.exp * 1000 - Date.now() > 30000) {
+                return true;
+            }
+        } catch (error) {
+            // Unreadable token; let the refresh decide
+        }
+        return this.refreshSession();
+    }
+
     // Verify token is still valid
     async verifyToken() {
         try {
-            const response = await fetch(`${this.apiBaseUrl}/profile`, {
+            const check = () => fetch(`${this.apiBaseUrl}/profile`, {
                 headers: {
                     'Authorization': `Bearer ${this.token}`,
                     'Content-Type': 'application/json'
                 }
             });
+            let response = await check();
+            if (response.status === 401 && await this.refreshSession()) {
+                response = await check();
+            }
             return response.ok;
         } catch (error) {
             console.error('Token verification failed:', error);
@@ -310,7 +523,15 @@ class ChatApp {
         try {
             // Connect to WebSocket server through nginx proxy
             const protocol = window.location.protocol === 'https:' ? 'wss:' : 'ws:';
-            const wsUrl = `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(this.token)}`;
+            let wsUrl = `${protocol}//${window.location.host}/ws?token=${encodeURIComponent(this.token)}`;
+            const deviceId = localStorage.getItem('deviceId');
+            if (deviceId) {
+                wsUrl += `&device_id=${encodeURIComponent(deviceId)}`;
+            }
+            // Ask for the events missed since the last one seen on this page
+            if (this.lastSeq) {
+                wsUrl += `&since=${this.lastSeq}`;
+            }
             this.websocket = new WebSocket(wsUrl);
 
             this.websocket.onopen = () => {
@@ -336,7 +557,15 @@ class ChatApp {
                 if (this.token && this.wsReconnectAttempts < this.maxReconnectAttempts) {
                     this.wsReconnectAttempts++;
                     console.log(`Attempting to reconnect WebSocket (${this.wsReconnectAttempts}/${this.maxReconnectAttempts})`);
-                    setTimeout(() => this.connectWebSocket(), 3000 * this.wsReconnectAttempts);
+                    setTimeout(() => {
+                        this.ensureFreshToken().then(ok => {
+                            if (ok) {
+                                this.connectWebSocket();
+                            } else {
+                                this.handleInvalidAuth();
+                            }
+                        });
+                    }, 3000 * this.wsReconnectAttempts);
                 }
             };
 
@@ -349,6 +578,12 @@ class ChatApp {
         }
     }
 
+    sendWebSocketFrame(frame) {
+        if (this.websocket && this.websocket.readyState === WebSocket.OPEN) {
+            this.websocket.send(JSON.stringify(frame));
+        }
+    }
+
     disconnectWebSocket() {
         if (this.websocket) {
             this.websocket.close();
@@ -358,10 +593,50 @@ class ChatApp {
     }
 
     handleWebSocketMessage(data) {
+        if (data.seq && data.seq > (this.lastSeq || 0)) {
+            this.lastSeq = data.seq;
+        }
+
         switch (data.type) {
+            case 'connected':
+                // Remember the server-assigned device ID so reconnects keep the same identity
+                localStorage.setItem('deviceId', data.data.device_id);
+                break;
             case 'new_message':
                 this.handleNewMessageNotification(data.data);
                 break;
+            case 'replay_complete':
+                this.lastSeq = Math.max(this.lastSeq || 0, data.data.seq);
+                break;
+            case 'resync_required':
+                // Too many events were missed to replay; reload from the API
+                this.lastSeq = null;
+                this.loadUsers();
+                this.loadConversation();
+                break;
+            case 'group_updated':
+                // Renames and membership changes; the client has no group view yet
+                break;
+            case 'conversation_updated':
+                // Sidebar entries still come from /users; nothing to update yet
+                break;
+            case 'channel_message':
+            case 'subscribed':
+            case 'unsubscribed':
+                // The client does not subscribe to channels yet
+                break;
+            case 'message_edited':
+                // The sender changed a message we may be showing
+                this.loadConversation();
+                break;
+            case 'message_deleted':
+                // A moderator removed a message we may be showing
+                this.loadConversation();
+                break;
+            case 'session_revoked':
+                // Logged out elsewhere, or the session was revoked
+                this.handleInvalidAuth();
+                break;
             case 'pong':
                 // Handle pong for keepalive
                 break;
@@ -373,9 +648,14 @@ class ChatApp {
     handleNewMessageNotification(message) {
         // Show notification for new messages
         if (message.sender_id !== this.user.id) {
+            // Acknowledge delivery so the sender sees the delivered status
+            this.sendWebSocketFrame({ type: 'ack', message_ids: [message.id] });
+
             // It's a message from someone else
             if (message.message_type === 'broadcast') {
                 this.showInfo(`New broadcast from ${message.sender_username}: ${message.content.substring(0, 50)}...`);
+            } else if (message.message_type === 'group') {
+                this.showInfo(`New group message from ${message.sender_username}: ${message.content.substring(0, 50)}...`);
             } else {
                 this.showInfo(`New message from ${message.sender_username}: ${message.content.substring(0, 50)}...`);
             }
@@ -474,7 +754,8 @@ class ChatApp {
             const response = await this.apiCall(`/conversations/${this.selectedUser.id}`);
             
             if (response.success) {
-                this.displayMessages(response.data);
+                this.displayMessages(response.data.messages);
+                this.showLoadOlder(response.data);
             } else {
                 this.displayMessages('Failed to load conversation');
             }
@@ -484,6 +765,54 @@ class ChatApp {
         }
     }
 
+    // Offers the messages before the oldest one shown, if there are any
+    showLoadOlder(page) {
+        let button = document.getElementById('loadOlderBtn');
+        if (!page.has_more) {
+            if (button) button.remove();
+            return;
+        }
+
+        if (!button) {
+            button = document.createElement('button');
+            button.id = 'loadOlderBtn';
+            button.className = 'btn-small load-older';
+            button.textContent = 'Load older messages';
+            document.getElementById('messagesList').prepend(button);
+        }
+        button.onclick = () => this.loadOlderMessages(page.next_cursor);
+    }
+
+    async loadOlderMessages(cursor) {
+        if (!this.selectedUser) return;
+        const userId = this.selectedUser.id;
+
+        try {
+            const response = await this.apiCall(`/conversations/${userId}?before=${encodeURIComponent(cursor)}`);
+            // The conversation may have been switched or reloaded meanwhile
+            const button = document.getElementById('loadOlderBtn');
+            if (!this.selectedUser || this.selectedUser.id !== userId || !button) return;
+
+            if (!response.success) {
+                this.showError('Failed to load older messages');
+                return;
+            }
+
+            // Keep the messages on screen where they were
+            const container = document.getElementById('messagesContainer');
+            const fromBottom = container.scrollHeight - container.scrollTop;
+            const oldest = button.nextSibling;
+            response.data.messages.forEach(message => {
+                this.addMessageToDOM(message, oldest);
+            });
+            this.showLoadOlder(response.data);
+            container.scrollTop = container.scrollHeight - fromBottom;
+        } catch (error) {
+            console.error('Error loading older messages:', error);
+            this.showError('Failed to load older messages');
+        }
+    }
+
     displayMessages(messages) {
         const messagesList = document.getElementById('messagesList');
         messagesList.innerHTML = '';
@@ -500,7 +829,7 @@ class ChatApp {
         this.scrollToBottom();
     }
 
-    addMessageToDOM(message) {
+    addMessageToDOM(message, before = null) {
         const messagesList = document.getElementById('messagesList');
         const messageDiv = document.createElement('div');
         messageDiv.className = `message ${message.message_type}`;
@@ -527,16 +856,17 @@ class ChatApp {
         messageDiv.innerHTML = `
             <div class="message-header">
                 <div>
+                    ${message.sender_avatar_url ? `<img class="message-avatar" src="${this.escapeHtml(message.sender_avatar_url)}" alt="" />` : ''}
                     <span class="message-author">${this.escapeHtml(message.sender_username)}</span>
                     <span class="message-type ${message.message_type}">${message.message_type}</span>
                 </div>
-                <span class="message-time">${time}</span>
+                <span class="message-time">${time}${message.edited_at ? ' <span class="message-edited">(edited)</span>' : ''}</span>
             </div>
             <div class="message-content">${this.escapeHtml(message.content)}</div>
             ${mediaHtml}
         `;
 
-        messagesList.appendChild(messageDiv);
+        messagesList.insertBefore(messageDiv, before);
     }
 
     async handleFileSelect(file) {
@@ -587,6 +917,7 @@ class ChatApp {
         formData.append('file', file);
 
         try {
+            await this.ensureFreshToken();
             const response = await fetch(`${this.apiBaseUrl}/media/upload`, {
                 method: 'POST',
                 headers: {
@@ -717,7 +1048,7 @@ class ChatApp {
                         <span class="message-type ${message.message_type}">${message.message_type}</span>
                         ${isOwn ? '<small>(You)</small>' : ''}
                     </div>
-                    <span class="message-time">${time}</span>
+                    <span class="message-time">${time}${message.edited_at ? ' <span class="message-edited">(edited)</span>' : ''}</span>
                 </div>
                 <div class="message-content">${this.escapeHtml(message.content)}</div>
                 ${message.media_url ? `<div><a href="${message.media_url}" target="_blank">📎 Media</a></div>` : ''}
@@ -737,7 +1068,13 @@ class ChatApp {
         };
 
         try {
-            const response = await fetch(url, { ...defaultOptions, ...options });
+            let response = await fetch(url, { ...defaultOptions, ...options });
+
+            // An expired access token is renewed once before giving up
+            if (response.status === 401 && !endpoint.includes('/auth/') && await this.refreshSession()) {
+                defaultOptions.headers['Authorization'] = `Bearer ${this.token}`;
+                response = await fetch(url, { ...defaultOptions, ...options });
+            }
             
             // Handle authentication errors
             if (response.status === 401 && !endpoint.includes('/auth/')) {
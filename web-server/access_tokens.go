@@ -0,0 +1,200 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Scopes a personal access token can be granted
+const (
+	ScopeProfileRead   = "profile:read"
+	ScopeProfileWrite  = "profile:write"
+	ScopeUsersRead     = "users:read"
+	ScopeMessagesRead  = "messages:read"
+	ScopeMessagesWrite = "messages:write"
+	ScopeMediaRead     = "media:read"
+	ScopeMediaWrite    = "media:write"
+
+	// ScopeAccount covers the password, sessions, 2FA, tokens and bots. It cannot be
+	// granted to a personal access token, so a leaked token cannot mint more.
+	ScopeAccount = "account"
+)
+
+var grantableScopes = []string{
+	ScopeProfileRead, ScopeProfileWrite, ScopeUsersRead,
+	ScopeMessagesRead, ScopeMessagesWrite,
+	ScopeMediaRead, ScopeMediaWrite,
+}
+
+// sessionScopes are held by every access token obtained by logging in
+var sessionScopes = append([]string{ScopeAccount}, grantableScopes...)
+
+// personalTokenPrefix tells personal access tokens apart from JWTs in the Authorization header
+const personalTokenPrefix = "pat_"
+
+var ErrInvalidAccessToken = errors.New("invalid personal access token")
+
+// AccessTokens manages personal access tokens, stored as SHA-256 hashes
+type AccessTokens struct {
+	db *sql.DB
+}
+
+func NewAccessTokens(db *sql.DB) *AccessTokens {
+	return &AccessTokens{db: db}
+}
+
+// Create mints a token for userID and returns the plain token, which is only shown once
+func (t *AccessTokens) Create(userID int, name string, scopes []string, expiresAt *time.Time) (PersonalAccessToken, string, error) {
+	var pat PersonalAccessToken
+
+	secret, err := randomToken(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return pat, "", err
+	}
+	token := personalTokenPrefix + secret
+
+	result, err := t.db.Exec(
+		"INSERT INTO personal_access_tokens (user_id, name, token_hash, token_prefix, scopes, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		userID, name, hashToken(token), token[:12], strings.Join(scopes, " "), expiresAt,
+	)
+	if err != nil {
+		return pat, "", err
+	}
+
+	id, _ := result.LastInsertId()
+	pat = PersonalAccessToken{
+		ID:        int(id),
+		UserID:    userID,
+		Name:      name,
+		Prefix:    token[:12],
+		Scopes:    scopes,
+		CreatedAt: time.Now(),
+		ExpiresAt: expiresAt,
+	}
+	return pat, token, nil
+}
+
+// List returns the user's tokens that have not been revoked
+func (t *AccessTokens) List(userID int) ([]PersonalAccessToken, error) {
+	rows, err := t.db.Query(`
+		SELECT id, user_id, name, token_prefix, scopes, created_at, last_used_at, expires_at
+		FROM personal_access_tokens
+		WHERE user_id = ? AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := []PersonalAccessToken{}
+	for rows.Next() {
+		var pat PersonalAccessToken
+		var scopes string
+		if err := rows.Scan(&pat.ID, &pat.UserID, &pat.Name, &pat.Prefix, &scopes, &pat.CreatedAt, &pat.LastUsedAt, &pat.ExpiresAt); err != nil {
+			return nil, err
+		}
+		pat.Scopes = strings.Fields(scopes)
+		tokens = append(tokens, pat)
+	}
+	return tokens, rows.Err()
+}
+
+// Revoke revokes a token owned by userID, or by one of userID's bots. It
+// reports false if there is no such live token.
+func (t *AccessTokens) Revoke(userID, tokenID int) (bool, error) {
+	result, err := t.db.Exec(`
+		UPDATE personal_access_tokens p
+		JOIN users u ON p.user_id = u.id
+		SET p.revoked_at = NOW()
+		WHERE p.id = ? AND p.revoked_at IS NULL AND (u.id = ? OR u.owner_id = ?)
+	`, tokenID, userID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n > 0, nil
+}
+
+// Authenticate resolves a personal access token to its user and scopes. Tokens
+// of suspended users, and of bots whose owner is suspended, are refused.
+func (t *AccessTokens) Authenticate(token string) (User, []string, error) {
+	var user User
+	var tokenID int
+	var scopes string
+	err := t.db.QueryRow(`
+		SELECT p.id, p.scopes, u.id, u.username, u.email, u.role
+		FROM personal_access_tokens p
+		JOIN users u ON p.user_id = u.id
+		LEFT JOIN users owner ON u.owner_id = owner.id
+		WHERE p.token_hash = ? AND p.revoked_at IS NULL AND (p.expires_at IS NULL OR p.expires_at > NOW())
+		  AND u.suspended_at IS NULL AND owner.suspended_at IS NULL
+	`, hashToken(token)).Scan(&tokenID, &scopes, &user.ID, &user.Username, &user.Email, &user.Role)
+	if err == sql.ErrNoRows {
+		return user, nil, ErrInvalidAccessToken
+	}
+	if err != nil {
+		return user, nil, err
+	}
+
+	// Only written once a minute so busy bots do not turn every request into a write
+	if _, err := t.db.Exec(
+		"UPDATE personal_access_tokens SET last_used_at = NOW() WHERE id = ? AND (last_used_at IS NULL OR last_used_at < NOW() - INTERVAL 1 MINUTE)",
+		tokenID,
+	); err != nil {
+		log.Printf("Failed to update last use of access token %d: %v", tokenID, err)
+	}
+
+	return user, strings.Fields(scopes), nil
+}
+
+// validateScopes rejects unknown scopes and scopes that cannot be granted
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errors.New("At least one scope is required")
+	}
+	for _, scope := range scopes {
+		if !containsScope(grantableScopes, scope) {
+			return errors.New("Invalid scope: " + scope)
+		}
+	}
+	return nil
+}
+
+func containsScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// RequireScope restricts a route group to credentials holding scope. Must run after AuthMiddleware.
+func RequireScope(scope string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !containsScope(GetScopesFromContext(c), scope) {
+			c.JSON(http.StatusForbidden, ApiResponse{
+				Success: false,
+				Error:   "Token is missing the " + scope + " scope",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GetScopesFromContext returns the scopes of the request's credentials
+func GetScopesFromContext(c *gin.Context) []string {
+	scopes, _ := c.Get("scopes")
+	list, _ := scopes.([]string)
+	return list
+}
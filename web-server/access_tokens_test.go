@@ -0,0 +1,59 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestValidateScopes(t *testing.T) {
+	tests := []struct {
+		scopes []string
+		ok     bool
+	}{
+		{[]string{ScopeMessagesRead, ScopeMessagesWrite}, true},
+		{nil, false},
+		{[]string{ScopeMessagesRead, "messages:delete"}, false},
+		{[]string{ScopeAccount}, false},
+	}
+	for _, tt := range tests {
+		if err := validateScopes(tt.scopes); (err == nil) != tt.ok {
+			t.Errorf("validateScopes(%v) = %v, want ok=%v", tt.scopes, err, tt.ok)
+		}
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name   string
+		scopes []string
+		want   int
+	}{
+		{"session", sessionScopes, http.StatusOK},
+		{"granted", []string{ScopeMessagesRead}, http.StatusOK},
+		{"missing", []string{ScopeMessagesWrite}, http.StatusForbidden},
+		{"none", nil, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := gin.New()
+			r.GET("/", func(c *gin.Context) {
+				if tt.scopes != nil {
+					c.Set("scopes", tt.scopes)
+				}
+			}, RequireScope(ScopeMessagesRead), func(c *gin.Context) {
+				c.Status(http.StatusOK)
+			})
+
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+			if w.Code != tt.want {
+				t.Errorf("status %d, want %d", w.Code, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,596 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"chatapp/auth"
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+// likeEscaper escapes user input for use in a LIKE pattern
+var likeEscaper = strings.NewReplacer("\\", "\\\\", "%", "\\%", "_", "\\_")
+
+type AdminHandler struct {
+	db       *sql.DB
+	outbox   *Outbox
+	sessions *Sessions
+}
+
+func NewAdminHandler(db *sql.DB, outbox *Outbox, sessions *Sessions) *AdminHandler {
+	return &AdminHandler{db: db, outbox: outbox, sessions: sessions}
+}
+
+// ListOutbox shows notifications that have not been delivered yet, oldest first.
+// Defaults to dead-lettered entries; pass ?status=pending to see retries in flight.
+func (h *AdminHandler) ListOutbox(c *gin.Context) {
+	status := c.DefaultQuery("status", "dead")
+	if status != "pending" && status != "dead" && status != "delivered" {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid status. Must be 'pending', 'dead' or 'delivered'",
+		})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	rows, err := h.db.Query(`
+		SELECT id, event_type, payload, status, attempts, last_error, next_attempt_at, parked_at, created_at, delivered_at
+		FROM outbox
+		WHERE status = ?
+		ORDER BY id
+		LIMIT ?
+	`, status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch outbox entries",
+		})
+		return
+	}
+	defer rows.Close()
+
+	entries := []OutboxEntry{}
+	for rows.Next() {
+		var entry OutboxEntry
+		var payload []byte
+		err := rows.Scan(
+			&entry.ID, &entry.EventType, &payload, &entry.Status, &entry.Attempts,
+			&entry.LastError, &entry.NextAttemptAt, &entry.ParkedAt, &entry.CreatedAt, &entry.DeliveredAt,
+		)
+		if err != nil {
+			continue
+		}
+		entry.Payload = payload
+		entries = append(entries, entry)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    entries,
+	})
+}
+
+// RetryOutbox puts a dead-lettered entry back in the queue with a fresh attempt
+// budget. It is parked, so a retry never holds back newer notifications.
+func (h *AdminHandler) RetryOutbox(c *gin.Context) {
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid outbox entry ID",
+		})
+		return
+	}
+
+	result, err := h.db.Exec(
+		"UPDATE outbox SET status = 'pending', attempts = 0, next_attempt_at = NOW(), parked_at = COALESCE(parked_at, NOW()) WHERE id = ? AND status = 'dead'",
+		id,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to retry outbox entry",
+		})
+		return
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Dead outbox entry not found",
+		})
+		return
+	}
+	h.outbox.Wake()
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Outbox entry queued for retry",
+	})
+}
+
+// ListUsers lists accounts with their role and suspension state. Filters:
+// ?q= matches the start of the username or email, ?role=, ?suspended=true.
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+	offset, _ := strconv.Atoi(c.DefaultQuery("offset", "0"))
+	if offset < 0 {
+		offset = 0
+	}
+
+	query := `
+		SELECT id, username, email, role, suspended_at, suspended_reason, is_bot,
+		       email_verified_at, presence_status, last_seen_at, created_at, updated_at
+		FROM users
+		WHERE 1 = 1
+	`
+	var args []interface{}
+
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		pattern := likeEscaper.Replace(q) + "%"
+		query += " AND (username LIKE ? OR email LIKE ?)"
+		args = append(args, pattern, pattern)
+	}
+	if role := c.Query("role"); role != "" {
+		if !auth.ValidRole(role) {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Invalid role. Must be 'user', 'moderator' or 'admin'",
+			})
+			return
+		}
+		query += " AND role = ?"
+		args = append(args, role)
+	}
+	if c.Query("suspended") == "true" {
+		query += " AND suspended_at IS NOT NULL"
+	}
+
+	query += " ORDER BY username LIMIT ? OFFSET ?"
+	args = append(args, limit, offset)
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch users",
+		})
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&user.ID, &user.Username, &user.Email, &user.Role, &user.SuspendedAt, &user.SuspendedReason, &user.IsBot,
+			&user.EmailVerifiedAt, &user.Status, &user.LastSeenAt, &user.CreatedAt, &user.UpdatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    UserListResponse{Users: users},
+	})
+}
+
+// SuspendUser blocks an account from logging in and signs it out everywhere.
+// Moderators and admins can only suspend accounts with a lower role.
+func (h *AdminHandler) SuspendUser(c *gin.Context) {
+	var req SuspendUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	target, ok := h.moderatableUser(c)
+	if !ok {
+		return
+	}
+
+	var reason interface{}
+	if req.Reason != "" {
+		reason = req.Reason
+	}
+	if _, err := h.db.Exec(
+		"UPDATE users SET suspended_at = NOW(), suspended_reason = ? WHERE id = ? AND suspended_at IS NULL",
+		reason, target,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to suspend user",
+		})
+		return
+	}
+
+	revoked, err := h.sessions.RevokeOthers(target, "", RevokedSuspended)
+	if err != nil {
+		log.Printf("Failed to revoke sessions of suspended user %d: %v", target, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "User suspended, but signing them out failed",
+		})
+		return
+	}
+
+	actorID, actorName, _ := GetUserFromContext(c)
+	log.Printf("User %d suspended by %s (%d), %d sessions revoked", target, actorName, actorID, revoked)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "User suspended",
+	})
+}
+
+// UnsuspendUser lets a suspended account log in again
+func (h *AdminHandler) UnsuspendUser(c *gin.Context) {
+	target, ok := h.moderatableUser(c)
+	if !ok {
+		return
+	}
+
+	if _, err := h.db.Exec(
+		"UPDATE users SET suspended_at = NULL, suspended_reason = NULL WHERE id = ?",
+		target,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to unsuspend user",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "User unsuspended",
+	})
+}
+
+// SetUserRole changes a user's role. It takes effect on their next token
+// refresh, at most ACCESS_TOKEN_TTL later.
+func (h *AdminHandler) SetUserRole(c *gin.Context) {
+	var req UpdateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil || !auth.ValidRole(req.Role) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid role. Must be 'user', 'moderator' or 'admin'",
+		})
+		return
+	}
+
+	target, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid user ID",
+		})
+		return
+	}
+
+	// Admins cannot demote themselves, so there is always at least one admin
+	if actorID, _, _ := GetUserFromContext(c); target == actorID {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "You cannot change your own role",
+		})
+		return
+	}
+
+	var oldRole string
+	err = h.db.QueryRow("SELECT role FROM users WHERE id = ?", target).Scan(&oldRole)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "User not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	if _, err := h.db.Exec("UPDATE users SET role = ? WHERE id = ?", req.Role, target); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to update role",
+		})
+		return
+	}
+
+	// Access and refresh tokens carry the role, so a demoted user is signed
+	// out everywhere rather than keeping the old role until they expire
+	if !auth.RoleAtLeast(req.Role, oldRole) {
+		revoked, err := h.sessions.RevokeOthers(target, "", RevokedRoleChanged)
+		if err != nil {
+			log.Printf("Failed to revoke sessions of demoted user %d: %v", target, err)
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Role updated, but signing them out failed",
+			})
+			return
+		}
+		actorID, actorName, _ := GetUserFromContext(c)
+		log.Printf("User %d demoted from %s to %s by %s (%d), %d sessions revoked", target, oldRole, req.Role, actorName, actorID, revoked)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Role updated",
+	})
+}
+
+// DeleteMessage removes a message for everyone and tells connected clients to drop it
+func (h *AdminHandler) DeleteMessage(c *gin.Context) {
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid message ID",
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	message := Message{ID: messageID}
+	err = tx.QueryRow(
+		"SELECT sender_id, message_type, conversation_id, channel_id FROM messages WHERE id = ? FOR UPDATE", messageID,
+	).Scan(&message.SenderID, &message.MessageType, &message.ConversationID, &message.ChannelID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Message not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	userIDs := []int{message.SenderID}
+	rows, err := tx.Query("SELECT recipient_id FROM message_recipients WHERE message_id = ?", messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	for rows.Next() {
+		var recipientID int
+		if err := rows.Scan(&recipientID); err == nil {
+			userIDs = append(userIDs, recipientID)
+		}
+	}
+	rows.Close()
+
+	// message_recipients rows go with it (ON DELETE CASCADE)
+	if _, err := tx.Exec("DELETE FROM messages WHERE id = ?", messageID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to delete message",
+		})
+		return
+	}
+
+	if err := h.outbox.Enqueue(tx, MessageDeletedNotification(message, userIDs)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue notification",
+		})
+		return
+	}
+	// The conversation's last message or unread count may have changed
+	if err := enqueueConversationUpdates(tx, h.outbox, messaging.ConversationKeys(message, userIDs[1:])); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue notification",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to commit transaction",
+		})
+		return
+	}
+	h.outbox.Wake()
+
+	actorID, actorName, _ := GetUserFromContext(c)
+	log.Printf("Message %d by user %d deleted by %s (%d)", messageID, message.SenderID, actorName, actorID)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Message deleted",
+	})
+}
+
+// GetMessageRevisions returns a message with the content it had before each
+// of its edits, oldest first
+func (h *AdminHandler) GetMessageRevisions(c *gin.Context) {
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid message ID",
+		})
+		return
+	}
+
+	messages, err := queryMessages(h.db, "SELECT "+messaging.Columns+" FROM messages m JOIN users u ON m.sender_id = u.id WHERE m.id = ?", messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if len(messages) == 0 {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Message not found",
+		})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT r.id, r.message_id, r.content, r.edited_by, u.username, r.created_at
+		FROM message_revisions r
+		LEFT JOIN users u ON r.edited_by = u.id
+		WHERE r.message_id = ?
+		ORDER BY r.id
+	`, messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch revisions",
+		})
+		return
+	}
+	defer rows.Close()
+
+	revisions := []MessageRevision{}
+	for rows.Next() {
+		var revision MessageRevision
+		err := rows.Scan(
+			&revision.ID, &revision.MessageID, &revision.Content,
+			&revision.EditedBy, &revision.EditedByUsername, &revision.CreatedAt,
+		)
+		if err != nil {
+			continue
+		}
+		revisions = append(revisions, revision)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data: MessageRevisionsResponse{
+			Message:   messages[0],
+			Revisions: revisions,
+		},
+	})
+}
+
+// GetBroadcastPolicy returns the least privileged role allowed to send broadcasts
+func (h *AdminHandler) GetBroadcastPolicy(c *gin.Context) {
+	minRole, err := messaging.BroadcastMinRole(h.db)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    BroadcastPolicy{MinRole: minRole},
+	})
+}
+
+// SetBroadcastPolicy changes who may send broadcast messages, on both servers
+func (h *AdminHandler) SetBroadcastPolicy(c *gin.Context) {
+	var req BroadcastPolicy
+	if err := c.ShouldBindJSON(&req); err != nil || !auth.ValidRole(req.MinRole) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid role. Must be 'user', 'moderator' or 'admin'",
+		})
+		return
+	}
+
+	actorID, _, _ := GetUserFromContext(c)
+	_, err := h.db.Exec(
+		"INSERT INTO app_settings (name, value, updated_by) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE value = VALUES(value), updated_by = VALUES(updated_by)",
+		messaging.SettingBroadcastMinRole, req.MinRole, actorID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to update broadcast policy",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Broadcast policy updated",
+		Data:    req,
+	})
+}
+
+// moderatableUser resolves the :id parameter to a user the caller outranks,
+// answering the request itself if there is none
+func (h *AdminHandler) moderatableUser(c *gin.Context) (int, bool) {
+	target, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid user ID",
+		})
+		return 0, false
+	}
+
+	var role string
+	err = h.db.QueryRow("SELECT role FROM users WHERE id = ?", target).Scan(&role)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "User not found",
+		})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return 0, false
+	}
+
+	if !auth.Outranks(GetRoleFromContext(c), role) {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "You can only moderate users with a lower role",
+		})
+		return 0, false
+	}
+	return target, true
+}
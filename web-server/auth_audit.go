@@ -0,0 +1,43 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Events recorded in the auth_audit table
+const (
+	AuditLoginSuccess   = "login_success"
+	AuditLoginFailure   = "login_failure"
+	AuditLoginThrottled = "login_throttled"
+	AuditMFAChallenge   = "mfa_challenge"
+	AuditMFAFailure     = "mfa_failure"
+	AuditLoginSuspended = "login_suspended"
+
+	AuditResetThrottled = "password_reset_throttled"
+
+	AuditPasswordChanged       = "password_changed"
+	AuditPasswordChangeFailure = "password_change_failure"
+	// AuditPasswordConfirmFailure is a wrong password confirming a sensitive
+	// account change, such as turning off 2FA
+	AuditPasswordConfirmFailure = "password_confirm_failure"
+)
+
+// recordAuthEvent appends an authentication attempt to the audit log. userID
+// is zero when the username did not match an account. Failures to write are
+// logged rather than failing the login.
+func recordAuthEvent(db *sql.DB, c *gin.Context, event string, userID int, username string) {
+	var uid interface{}
+	if userID != 0 {
+		uid = userID
+	}
+	_, err := db.Exec(
+		"INSERT INTO auth_audit (user_id, username, event, ip_address, user_agent) VALUES (?, ?, ?, ?, ?)",
+		uid, truncate(username, 100), event, c.ClientIP(), truncate(c.Request.UserAgent(), 255),
+	)
+	if err != nil {
+		log.Printf("Failed to record %s audit event for %q: %v", event, username, err)
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"log"
 	"net/http"
 
 	"github.com/gin-gonic/gin"
@@ -9,11 +11,16 @@ import (
 )
 
 type AuthHandler struct {
-	db *sql.DB
+	db       *sql.DB
+	sessions *Sessions
+	mailer   Mailer
+	throttle *LoginThrottle
+	// resets limits password reset requests, separately from logins
+	resets *LoginThrottle
 }
 
-func NewAuthHandler(db *sql.DB) *AuthHandler {
-	return &AuthHandler{db: db}
+func NewAuthHandler(db *sql.DB, sessions *Sessions, mailer Mailer, throttle, resets *LoginThrottle) *AuthHandler {
+	return &AuthHandler{db: db, sessions: sessions, mailer: mailer, throttle: throttle, resets: resets}
 }
 
 func (h *AuthHandler) Register(c *gin.Context) {
@@ -72,9 +79,18 @@ func (h *AuthHandler) Register(c *gin.Context) {
 		ID:       int(userID),
 		Username: req.Username,
 		Email:    req.Email,
+		Role:     RoleUser,
 	}
 
-	token, err := GenerateToken(user)
+	// New accounts start unverified; they can log in, but the verification
+	// policy may hold back some actions until the emailed link is followed
+	go func() {
+		if err := h.sendVerificationMail(user); err != nil {
+			log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		}
+	}()
+
+	tokens, err := h.sessions.Create(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
@@ -85,10 +101,12 @@ func (h *AuthHandler) Register(c *gin.Context) {
 
 	c.JSON(http.StatusCreated, ApiResponse{
 		Success: true,
-		Message: "User registered successfully",
+		Message: "User registered successfully, check your email to verify your address",
 		Data: AuthResponse{
-			Token: token,
-			User:  user,
+			Token:        tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresIn:    tokens.ExpiresIn,
+			User:         user,
 		},
 	})
 }
@@ -103,14 +121,20 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
+	if h.throttled(c, req.Username) {
+		return
+	}
+
 	var user User
 	var hashedPassword string
+	var mfaEnabledAt sql.NullTime
 	err := h.db.QueryRow(
-		"SELECT id, username, email, password_hash, created_at, updated_at FROM users WHERE username = ?",
+		"SELECT id, username, email, password_hash, email_verified_at, totp_enabled_at, role, suspended_at, created_at, updated_at FROM users WHERE username = ?",
 		req.Username,
-	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword, &user.CreatedAt, &user.UpdatedAt)
+	).Scan(&user.ID, &user.Username, &user.Email, &hashedPassword, &user.EmailVerifiedAt, &mfaEnabledAt, &user.Role, &user.SuspendedAt, &user.CreatedAt, &user.UpdatedAt)
 
 	if err == sql.ErrNoRows {
+		h.loginFailed(c, AuditLoginFailure, 0, req.Username)
 		c.JSON(http.StatusUnauthorized, ApiResponse{
 			Success: false,
 			Error:   "Invalid credentials",
@@ -128,6 +152,7 @@ func (h *AuthHandler) Login(c *gin.Context) {
 
 	err = bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.Password))
 	if err != nil {
+		h.loginFailed(c, AuditLoginFailure, user.ID, req.Username)
 		c.JSON(http.StatusUnauthorized, ApiResponse{
 			Success: false,
 			Error:   "Invalid credentials",
@@ -135,7 +160,37 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	token, err := GenerateToken(user)
+	if h.suspended(c, user) {
+		return
+	}
+
+	// With 2FA on, the password only earns a challenge to be completed at POST /api/auth/mfa.
+	// The account's failures are kept until the second factor succeeds too.
+	if mfaEnabledAt.Valid {
+		h.attemptPassed(c, user.Username)
+		recordAuthEvent(h.db, c, AuditMFAChallenge, user.ID, user.Username)
+		challenge, err := mfaChallengeToken(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to generate token",
+			})
+			return
+		}
+		c.JSON(http.StatusOK, ApiResponse{
+			Success: true,
+			Message: "Two-factor authentication required",
+			Data: MFAChallengeResponse{
+				MFARequired: true,
+				MFAToken:    challenge,
+			},
+		})
+		return
+	}
+
+	h.loginSucceeded(c, user)
+
+	tokens, err := h.sessions.Create(user, c.Request.UserAgent(), c.ClientIP())
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
@@ -148,21 +203,146 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		Success: true,
 		Message: "Login successful",
 		Data: AuthResponse{
-			Token: token,
-			User:  user,
+			Token:        tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresIn:    tokens.ExpiresIn,
+			User:         user,
+		},
+	})
+}
+
+// Refresh rotates a refresh token and returns a new access token. Presenting a
+// refresh token that was already rotated revokes the whole session.
+func (h *AuthHandler) Refresh(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	tokens, user, err := h.sessions.Refresh(req.RefreshToken, c.Request.UserAgent(), c.ClientIP())
+	if errors.Is(err, ErrInvalidRefreshToken) || errors.Is(err, ErrRefreshTokenReused) {
+		c.JSON(http.StatusUnauthorized, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to refresh session: %v", err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to refresh token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Token refreshed",
+		Data: AuthResponse{
+			Token:        tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresIn:    tokens.ExpiresIn,
+			User:         user,
 		},
 	})
 }
 
+// Logout revokes the session of the presented refresh token and disconnects
+// its WebSocket clients. It does not need a valid access token, so a client
+// whose access token already expired can still log out.
+func (h *AuthHandler) Logout(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := h.sessions.RevokeByRefreshToken(req.RefreshToken, RevokedLogout); err != nil {
+		log.Printf("Failed to revoke session: %v", err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to log out",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Logged out successfully",
+	})
+}
+
+// throttled reserves an attempt for the account from the client IP before
+// its credentials are checked. It answers 429 with Retry-After if the account
+// or the IP has failed too often recently. A reserved attempt counts as a
+// failure unless it is given back with loginSucceeded or attemptPassed.
+func (h *AuthHandler) throttled(c *gin.Context, username string) bool {
+	wait, err := h.throttle.Reserve(username, c.ClientIP())
+	if err != nil {
+		log.Printf("Login throttle unavailable: %v", err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	recordAuthEvent(h.db, c, AuditLoginThrottled, 0, username)
+	c.Header("Retry-After", retryAfterSeconds(wait))
+	c.JSON(http.StatusTooManyRequests, ApiResponse{
+		Success: false,
+		Error:   "Too many failed login attempts, try again later",
+	})
+	return true
+}
+
+// loginFailed audits a failed attempt; throttled has already counted it
+func (h *AuthHandler) loginFailed(c *gin.Context, event string, userID int, username string) {
+	recordAuthEvent(h.db, c, event, userID, username)
+}
+
+// attemptPassed gives back the attempt reserved by throttled once the
+// credentials turned out to be right
+func (h *AuthHandler) attemptPassed(c *gin.Context, username string) {
+	if err := h.throttle.Release(username, c.ClientIP()); err != nil {
+		log.Printf("Login throttle unavailable: %v", err)
+	}
+}
+
+// suspended rejects a login by a suspended account once its credentials have
+// been checked, so the response does not reveal suspension to password guessers
+func (h *AuthHandler) suspended(c *gin.Context, user User) bool {
+	if user.SuspendedAt == nil {
+		return false
+	}
+	h.attemptPassed(c, user.Username)
+	recordAuthEvent(h.db, c, AuditLoginSuspended, user.ID, user.Username)
+	c.JSON(http.StatusForbidden, ApiResponse{
+		Success: false,
+		Error:   ErrAccountSuspended.Error(),
+	})
+	return true
+}
+
+// loginSucceeded clears the account's failures and audits the login
+func (h *AuthHandler) loginSucceeded(c *gin.Context, user User) {
+	if err := h.throttle.Success(user.Username, c.ClientIP()); err != nil {
+		log.Printf("Login throttle unavailable: %v", err)
+	}
+	recordAuthEvent(h.db, c, AuditLoginSuccess, user.ID, user.Username)
+}
+
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	userID, _, _ := GetUserFromContext(c)
 
-	var user User
-	err := h.db.QueryRow(
-		"SELECT id, username, email, created_at, updated_at FROM users WHERE id = ?",
-		userID,
-	).Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt, &user.UpdatedAt)
-
+	user, err := loadProfile(h.db, userID)
 	if err != nil {
 		c.JSON(http.StatusNotFound, ApiResponse{
 			Success: false,
@@ -181,7 +361,7 @@ func (h *AuthHandler) GetUsers(c *gin.Context) {
 	userID, _, _ := GetUserFromContext(c)
 
 	rows, err := h.db.Query(
-		"SELECT id, username, email, created_at FROM users WHERE id != ? ORDER BY username",
+		"SELECT id, username, email, display_name, status_text, avatar_url, is_bot, created_at, presence_status, last_seen_at FROM users WHERE id != ? ORDER BY username",
 		userID,
 	)
 	if err != nil {
@@ -196,7 +376,7 @@ func (h *AuthHandler) GetUsers(c *gin.Context) {
 	var users []User
 	for rows.Next() {
 		var user User
-		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.CreatedAt)
+		err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.DisplayName, &user.StatusText, &user.AvatarURL, &user.IsBot, &user.CreatedAt, &user.Status, &user.LastSeenAt)
 		if err != nil {
 			continue
 		}
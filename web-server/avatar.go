@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// avatarSizes are the square thumbnails generated for every avatar, in
+// pixels. The first is the one stored as the user's avatar_url.
+var avatarSizes = []int{256, 64}
+
+const (
+	maxAvatarBytes = 5 << 20
+	// maxAvatarPixels bounds the decoded image so a small, highly compressed
+	// file cannot exhaust memory
+	maxAvatarPixels = 4096 * 4096
+	avatarPrefix    = "avatar_"
+)
+
+// UploadAvatar replaces the user's avatar. The image is cropped to a centred
+// square and scaled to each of avatarSizes; the original is not kept.
+func (h *MediaHandler) UploadAvatar(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxAvatarBytes+1<<20)
+	file, header, err := c.Request.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "No file uploaded",
+		})
+		return
+	}
+	defer file.Close()
+
+	if header.Size > maxAvatarBytes {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Avatar must be less than 5MB",
+		})
+		return
+	}
+
+	config, _, err := image.DecodeConfig(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Avatar must be a JPEG, PNG or GIF image",
+		})
+		return
+	}
+	if config.Width*config.Height > maxAvatarPixels {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Avatar dimensions are too large",
+		})
+		return
+	}
+
+	if _, err := file.Seek(0, 0); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to read file",
+		})
+		return
+	}
+	src, _, err := image.Decode(file)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Avatar must be a JPEG, PNG or GIF image",
+		})
+		return
+	}
+
+	userDir := filepath.Join(h.uploadDir, fmt.Sprintf("user_%d", userID))
+	if err := os.MkdirAll(userDir, 0755); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create user directory",
+		})
+		return
+	}
+
+	stamp := time.Now().Unix()
+	thumbnails := make(map[string]string, len(avatarSizes))
+	var written []string
+	for _, size := range avatarSizes {
+		filename := fmt.Sprintf("%s%d_%d.png", avatarPrefix, stamp, size)
+		if err := writePNG(filepath.Join(userDir, filename), squareThumbnail(src, size)); err != nil {
+			removeFiles(userDir, written)
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to save avatar",
+			})
+			return
+		}
+		written = append(written, filename)
+		thumbnails[strconv.Itoa(size)] = fmt.Sprintf("/api/media/user_%d/%s", userID, filename)
+	}
+	avatarURL := thumbnails[strconv.Itoa(avatarSizes[0])]
+
+	if _, err := h.db.Exec("UPDATE users SET avatar_url = ? WHERE id = ?", avatarURL, userID); err != nil {
+		removeFiles(userDir, written)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to update avatar",
+		})
+		return
+	}
+	h.removeOldAvatars(userDir, written)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Avatar updated",
+		Data: AvatarResponse{
+			AvatarURL:  avatarURL,
+			Thumbnails: thumbnails,
+		},
+	})
+}
+
+// DeleteAvatar removes the user's avatar
+func (h *MediaHandler) DeleteAvatar(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	if _, err := h.db.Exec("UPDATE users SET avatar_url = NULL WHERE id = ?", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to remove avatar",
+		})
+		return
+	}
+	h.removeOldAvatars(filepath.Join(h.uploadDir, fmt.Sprintf("user_%d", userID)), nil)
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Avatar removed",
+	})
+}
+
+// removeOldAvatars deletes avatar thumbnails in userDir other than keep
+func (h *MediaHandler) removeOldAvatars(userDir string, keep []string) {
+	entries, err := os.ReadDir(userDir)
+	if err != nil {
+		return
+	}
+	kept := make(map[string]bool, len(keep))
+	for _, name := range keep {
+		kept[name] = true
+	}
+	var stale []string
+	for _, entry := range entries {
+		if name := entry.Name(); strings.HasPrefix(name, avatarPrefix) && !kept[name] {
+			stale = append(stale, name)
+		}
+	}
+	removeFiles(userDir, stale)
+}
+
+func removeFiles(dir string, names []string) {
+	for _, name := range names {
+		if err := os.Remove(filepath.Join(dir, name)); err != nil && !os.IsNotExist(err) {
+			log.Printf("Failed to remove %s: %v", filepath.Join(dir, name), err)
+		}
+	}
+}
+
+func writePNG(path string, img image.Image) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// squareThumbnail crops the largest centred square out of src and scales it
+// to size x size. Each output pixel averages the source pixels it covers, so
+// downscaled photos stay smooth; small images are scaled up by repetition.
+func squareThumbnail(src image.Image, size int) *image.RGBA {
+	b := src.Bounds()
+	side := b.Dx()
+	if b.Dy() < side {
+		side = b.Dy()
+	}
+	x0 := b.Min.X + (b.Dx()-side)/2
+	y0 := b.Min.Y + (b.Dy()-side)/2
+
+	dst := image.NewRGBA(image.Rect(0, 0, size, size))
+	for dy := 0; dy < size; dy++ {
+		sy0, sy1 := span(dy, size, side)
+		for dx := 0; dx < size; dx++ {
+			sx0, sx1 := span(dx, size, side)
+
+			var r, g, bl, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := src.At(x0+sx, y0+sy).RGBA()
+					r, g, bl, a = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa)
+					n++
+				}
+			}
+			dst.SetRGBA(dx, dy, color.RGBA{
+				R: uint8(r / n >> 8),
+				G: uint8(g / n >> 8),
+				B: uint8(bl / n >> 8),
+				A: uint8(a / n >> 8),
+			})
+		}
+	}
+	return dst
+}
+
+// span returns the range of source pixels [from, to) that output pixel i of
+// size covers in a source of side pixels; never empty
+func span(i, size, side int) (int, int) {
+	from := i * side / size
+	to := (i + 1) * side / size
+	if to <= from {
+		to = from + 1
+	}
+	return from, to
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// stripes returns a w x h image whose left third is red, middle third green and right third blue
+func stripes(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			c := color.RGBA{B: 255, A: 255}
+			if x < w/3 {
+				c = color.RGBA{R: 255, A: 255}
+			} else if x < 2*w/3 {
+				c = color.RGBA{G: 255, A: 255}
+			}
+			img.SetRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestSquareThumbnailCropsCentre(t *testing.T) {
+	// 300x100: the centred 100x100 square is entirely the green stripe
+	thumb := squareThumbnail(stripes(300, 100), 64)
+
+	if b := thumb.Bounds(); b.Dx() != 64 || b.Dy() != 64 {
+		t.Fatalf("thumbnail is %dx%d, want 64x64", b.Dx(), b.Dy())
+	}
+	for _, p := range []image.Point{{0, 0}, {63, 0}, {32, 32}, {63, 63}} {
+		if got := thumb.RGBAAt(p.X, p.Y); got != (color.RGBA{G: 255, A: 255}) {
+			t.Errorf("pixel %v = %v, want green", p, got)
+		}
+	}
+}
+
+func TestSquareThumbnailAveragesWhenShrinking(t *testing.T) {
+	// A 2x2 checkerboard of black and white shrinks to one mid-grey pixel
+	img := image.NewRGBA(image.Rect(0, 0, 2, 2))
+	img.SetRGBA(0, 0, color.RGBA{255, 255, 255, 255})
+	img.SetRGBA(1, 1, color.RGBA{255, 255, 255, 255})
+	img.SetRGBA(1, 0, color.RGBA{0, 0, 0, 255})
+	img.SetRGBA(0, 1, color.RGBA{0, 0, 0, 255})
+
+	got := squareThumbnail(img, 1).RGBAAt(0, 0)
+	if got.R < 126 || got.R > 128 || got.A != 255 {
+		t.Errorf("averaged pixel = %v, want mid-grey", got)
+	}
+}
+
+func TestSquareThumbnailScalesUp(t *testing.T) {
+	thumb := squareThumbnail(stripes(3, 3), 9)
+
+	if got := thumb.RGBAAt(0, 4); got != (color.RGBA{R: 255, A: 255}) {
+		t.Errorf("left edge = %v, want red", got)
+	}
+	if got := thumb.RGBAAt(8, 4); got != (color.RGBA{B: 255, A: 255}) {
+		t.Errorf("right edge = %v, want blue", got)
+	}
+}
@@ -0,0 +1,413 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidChannelName = errors.New("Channel names must be at least 2 characters of lowercase letters, digits, '-' and '_'")
+	ErrNotChannelMember   = messaging.ErrNotChannelMember
+)
+
+var channelNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// channelSelect reads channels together with the requesting user's
+// membership; it takes the user ID twice
+const channelSelect = `
+	SELECT c.id, c.name, c.description, c.created_by, c.created_at,
+	       (SELECT COUNT(*) FROM channel_members WHERE channel_id = c.id),
+	       cm.user_id IS NOT NULL, cm.last_read_message_id,
+	       CASE WHEN cm.user_id IS NULL THEN 0 ELSE (
+	           SELECT COUNT(*) FROM messages m
+	           WHERE m.channel_id = c.id AND m.id > COALESCE(cm.last_read_message_id, 0) AND m.sender_id != ?
+	       ) END
+	FROM channels c
+	LEFT JOIN channel_members cm ON cm.channel_id = c.id AND cm.user_id = ?
+`
+
+// ChannelHandler manages public channels. Unlike groups, channel messages are
+// stored once per channel and members keep a read pointer instead of
+// per-recipient rows.
+type ChannelHandler struct {
+	db     *sql.DB
+	outbox *Outbox
+}
+
+func NewChannelHandler(db *sql.DB, outbox *Outbox) *ChannelHandler {
+	return &ChannelHandler{db: db, outbox: outbox}
+}
+
+// ListChannels lists every channel, or only joined ones with ?joined=true.
+// ?q= filters by name.
+func (h *ChannelHandler) ListChannels(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	query := channelSelect + " WHERE 1 = 1"
+	args := []interface{}{userID, userID}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		query += " AND c.name LIKE ?"
+		args = append(args, "%"+likeEscaper.Replace(q)+"%")
+	}
+	if c.Query("joined") == "true" {
+		query += " AND cm.user_id IS NOT NULL"
+	}
+	query += " ORDER BY c.name"
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch channels",
+		})
+		return
+	}
+	defer rows.Close()
+
+	channels := []Channel{}
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			continue
+		}
+		channels = append(channels, channel)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    ChannelListResponse{Channels: channels},
+	})
+}
+
+// CreateChannel creates a channel and joins the caller to it
+func (h *ChannelHandler) CreateChannel(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	var req CreateChannelRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	name, err := normalizeChannelName(req.Name)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE name = ?)", name).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Channel already exists",
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO channels (name, description, created_by) VALUES (?, ?, ?)",
+		name, nullableString(req.Description), userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create channel",
+		})
+		return
+	}
+	id, _ := result.LastInsertId()
+	channelID := int(id)
+
+	if _, err := tx.Exec("INSERT INTO channel_members (channel_id, user_id) VALUES (?, ?)", channelID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to join channel",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to commit transaction",
+		})
+		return
+	}
+
+	h.respondChannel(c, channelID, userID, http.StatusCreated, "Channel created")
+}
+
+// GetChannel returns a channel with the caller's membership and unread count
+func (h *ChannelHandler) GetChannel(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	channelID, ok := channelIDParam(c)
+	if !ok {
+		return
+	}
+
+	h.respondChannel(c, channelID, userID, http.StatusOK, "")
+}
+
+// JoinChannel adds the caller to a channel. Messages sent before joining
+// are not counted as unread.
+func (h *ChannelHandler) JoinChannel(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	channelID, ok := channelIDParam(c)
+	if !ok {
+		return
+	}
+
+	result, err := h.db.Exec(`
+		INSERT IGNORE INTO channel_members (channel_id, user_id, last_read_message_id)
+		SELECT c.id, ?, (SELECT MAX(id) FROM messages WHERE channel_id = c.id)
+		FROM channels c WHERE c.id = ?
+	`, userID, channelID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to join channel",
+		})
+		return
+	}
+
+	message := "Joined channel"
+	if affected, _ := result.RowsAffected(); affected == 0 {
+		message = "Already a member"
+	}
+	h.respondChannel(c, channelID, userID, http.StatusOK, message)
+}
+
+// LeaveChannel removes the caller from a channel and ends their WebSocket
+// subscriptions to it. Channels outlive their members.
+func (h *ChannelHandler) LeaveChannel(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	channelID, ok := channelIDParam(c)
+	if !ok {
+		return
+	}
+	if !requireChannelMember(c, h.db, channelID, userID) {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM channel_members WHERE channel_id = ? AND user_id = ?", channelID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to leave channel",
+		})
+		return
+	}
+
+	if err := h.outbox.Enqueue(tx, ChannelLeftNotification(channelID, userID)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue channel notification",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to commit transaction",
+		})
+		return
+	}
+	h.outbox.Wake()
+
+	h.respondChannel(c, channelID, userID, http.StatusOK, "Left channel")
+}
+
+// MarkChannelRead moves the caller's read pointer to message_id, or to the
+// latest message if none is given. The pointer never moves backwards.
+func (h *ChannelHandler) MarkChannelRead(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	channelID, ok := channelIDParam(c)
+	if !ok {
+		return
+	}
+
+	var req MarkChannelReadRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+	}
+
+	if !requireChannelMember(c, h.db, channelID, userID) {
+		return
+	}
+
+	// Only messages of this channel at or below the requested ID count
+	query := "SELECT MAX(id) FROM messages WHERE channel_id = ?"
+	args := []interface{}{channelID}
+	if req.MessageID != nil {
+		query += " AND id <= ?"
+		args = append(args, *req.MessageID)
+	}
+	var readTo sql.NullInt64
+	if err := h.db.QueryRow(query, args...).Scan(&readTo); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	if readTo.Valid {
+		_, err := h.db.Exec(`
+			UPDATE channel_members SET last_read_message_id = ?
+			WHERE channel_id = ? AND user_id = ? AND (last_read_message_id IS NULL OR last_read_message_id < ?)
+		`, readTo.Int64, channelID, userID, readTo.Int64)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to mark channel as read",
+			})
+			return
+		}
+	}
+
+	h.respondChannel(c, channelID, userID, http.StatusOK, "Channel marked as read")
+}
+
+// respondChannel answers with the channel as userID sees it
+func (h *ChannelHandler) respondChannel(c *gin.Context, channelID, userID, status int, message string) {
+	channel, err := loadChannel(h.db, channelID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Channel not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to load channel",
+		})
+		return
+	}
+
+	c.JSON(status, ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    channel,
+	})
+}
+
+// channelIDParam parses the :id parameter, answering 400 if it is not a number
+func channelIDParam(c *gin.Context) (int, bool) {
+	channelID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid channel ID",
+		})
+		return 0, false
+	}
+	return channelID, true
+}
+
+// requireChannelMember answers 404 for unknown channels and 403 unless
+// userID has joined the channel
+func requireChannelMember(c *gin.Context, db queryer, channelID, userID int) bool {
+	var member bool
+	err := db.QueryRow(`
+		SELECT cm.user_id IS NOT NULL
+		FROM channels c
+		LEFT JOIN channel_members cm ON cm.channel_id = c.id AND cm.user_id = ?
+		WHERE c.id = ?
+	`, userID, channelID).Scan(&member)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Channel not found",
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return false
+	}
+	if !member {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   ErrNotChannelMember.Error(),
+		})
+		return false
+	}
+	return true
+}
+
+// normalizeChannelName lowercases a channel name and strips a leading '#'
+func normalizeChannelName(name string) (string, error) {
+	name = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(name), "#"))
+	if len(name) < 2 || !channelNamePattern.MatchString(name) {
+		return "", ErrInvalidChannelName
+	}
+	return name, nil
+}
+
+func loadChannel(db queryer, channelID, userID int) (Channel, error) {
+	return scanChannel(db.QueryRow(channelSelect+" WHERE c.id = ?", userID, userID, channelID))
+}
+
+func scanChannel(row interface{ Scan(...interface{}) error }) (Channel, error) {
+	var channel Channel
+	err := row.Scan(
+		&channel.ID, &channel.Name, &channel.Description, &channel.CreatedBy, &channel.CreatedAt,
+		&channel.MemberCount, &channel.Joined, &channel.LastReadMessageID, &channel.UnreadCount,
+	)
+	return channel, err
+}
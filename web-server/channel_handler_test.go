@@ -0,0 +1,24 @@
+package main
+
+import "testing"
+
+func TestNormalizeChannelName(t *testing.T) {
+	valid := map[string]string{
+		"general":      "general",
+		"#Random":      "random",
+		"  dev-ops  ":  "dev-ops",
+		"release_2024": "release_2024",
+	}
+	for input, want := range valid {
+		got, err := normalizeChannelName(input)
+		if err != nil || got != want {
+			t.Errorf("normalizeChannelName(%q) = %q, %v; want %q", input, got, err, want)
+		}
+	}
+
+	for _, input := range []string{"", "#", "a", "-leading", "has space", "émoji", "semi;colon"} {
+		if _, err := normalizeChannelName(input); err != ErrInvalidChannelName {
+			t.Errorf("normalizeChannelName(%q) error = %v, want ErrInvalidChannelName", input, err)
+		}
+	}
+}
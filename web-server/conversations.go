@@ -0,0 +1,84 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+// ConversationKey identifies a conversation from one user's point of view
+type ConversationKey = messaging.ConversationKey
+
+// ListConversations returns the caller's direct and group conversations with
+// their last message and unread count, most recently active first. Pages are
+// fetched with ?before=<next_cursor> (or ?cursor=) instead of being counted.
+func (h *MessageHandler) ListConversations(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	// Page numbers are gone; rather than serve the first page again, tell
+	// older clients to follow next_cursor
+	if page := c.Query("page"); page != "" && page != "1" {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   ErrPageUnsupported.Error(),
+		})
+		return
+	}
+
+	raw := c.Query("before")
+	if raw == "" {
+		raw = c.Query("cursor")
+	}
+	var before Cursor
+	if raw != "" {
+		cursor, err := DecodeCursor(raw)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   err.Error(),
+			})
+			return
+		}
+		before = cursor
+	}
+
+	conversations, err := messaging.ListConversations(h.db, userID, before.CreatedAt, before.ID, limit+1)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch conversations",
+		})
+		return
+	}
+
+	response := ConversationListResponse{Conversations: conversations, Limit: limit}
+	if len(conversations) > limit {
+		response.Conversations = conversations[:limit]
+		response.HasMore = true
+		last := response.Conversations[limit-1]
+		response.NextCursor = Cursor{CreatedAt: last.LastActivityAt, ID: last.ActivityID}.Encode()
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    response,
+	})
+}
+
+// enqueueConversationUpdates queues the changed conversations of each user.
+// The WebSocket server loads each user's view of them once tx has committed,
+// so the transaction does not pay for the conversation queries.
+func enqueueConversationUpdates(tx *sql.Tx, outbox *Outbox, keys map[int][]ConversationKey) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	return outbox.Enqueue(tx, ConversationsChangedNotification(keys))
+}
@@ -0,0 +1,273 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+var (
+	ErrInvalidCursor   = errors.New("Invalid cursor")
+	ErrCursorConflict  = errors.New("Use only one of before, after and around")
+	ErrAnchorNotFound  = errors.New("Message not found")
+	ErrPageUnsupported = errors.New("Page numbers are not supported; pass next_cursor as before")
+	errPageNumbered    = errors.New("page-numbered request")
+)
+
+// Cursor is a position in a message listing. Messages are ordered by
+// (created_at, id) so that messages sharing a timestamp keep a stable order.
+// The conversation list uses it with the last activity and activity ID,
+// which is negative for groups without messages.
+type Cursor struct {
+	CreatedAt time.Time
+	ID        int
+}
+
+func cursorOf(message Message) Cursor {
+	return Cursor{CreatedAt: message.CreatedAt, ID: message.ID}
+}
+
+// Encode returns the cursor as an opaque URL-safe string
+func (c Cursor) Encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", c.CreatedAt.UnixNano(), c.ID)))
+}
+
+// DecodeCursor parses a cursor produced by Encode
+func DecodeCursor(s string) (Cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	nanos, id, ok := strings.Cut(string(raw), ":")
+	if !ok {
+		return Cursor{}, ErrInvalidCursor
+	}
+	n, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return Cursor{}, ErrInvalidCursor
+	}
+	cursorID, err := strconv.Atoi(id)
+	if err != nil || cursorID == 0 {
+		return Cursor{}, ErrInvalidCursor
+	}
+	return Cursor{CreatedAt: time.Unix(0, n), ID: cursorID}, nil
+}
+
+// pageRequest holds the cursor parameters of a message listing: at most one
+// of Before, After and Around is set
+type pageRequest struct {
+	Before *Cursor
+	After  *Cursor
+	Around int
+	Limit  int
+}
+
+// parsePageRequest reads ?before= (or its alias ?cursor=), ?after=, ?around=
+// and ?limit=. Without any of them the page starts from the newest message,
+// unless ?page= is passed: then it returns errPageNumbered, with the limit
+// read, so endpoints that kept page numbers can fall back to them.
+func parsePageRequest(c *gin.Context) (pageRequest, error) {
+	req := pageRequest{Limit: 50}
+	if limit, err := strconv.Atoi(c.Query("limit")); err == nil && limit >= 1 && limit <= 100 {
+		req.Limit = limit
+	}
+
+	before, hasBefore := c.GetQuery("before")
+	alias, hasAlias := c.GetQuery("cursor")
+	after, around := c.Query("after"), c.Query("around")
+	set := 0
+	for _, present := range []bool{hasBefore, hasAlias, after != "", around != ""} {
+		if present {
+			set++
+		}
+	}
+	if set == 0 {
+		if _, numbered := c.GetQuery("page"); numbered {
+			return req, errPageNumbered
+		}
+		return req, nil
+	}
+	if set > 1 {
+		return req, ErrCursorConflict
+	}
+	if hasAlias {
+		before, hasBefore = alias, true
+	}
+
+	switch {
+	case hasBefore:
+		if before == "" {
+			break
+		}
+		cursor, err := DecodeCursor(before)
+		if err != nil {
+			return req, err
+		}
+		req.Before = &cursor
+	case after != "":
+		cursor, err := DecodeCursor(after)
+		if err != nil {
+			return req, err
+		}
+		req.After = &cursor
+	default:
+		id, err := strconv.Atoi(around)
+		if err != nil || id < 1 {
+			return req, ErrInvalidCursor
+		}
+		req.Around = id
+	}
+	return req, nil
+}
+
+// messagePage is one page of a cursor-paginated listing, oldest message first
+type messagePage struct {
+	Messages []Message
+	// HasMore reports whether there are messages beyond the page in the
+	// direction it was fetched: newer for after, older otherwise
+	HasMore bool
+}
+
+// fetchMessagePage pages through the messages matched by base, a SELECT of
+// messaging.Columns ending in a WHERE clause, without counting them
+func fetchMessagePage(db *sql.DB, base string, args []interface{}, req pageRequest) (messagePage, error) {
+	switch {
+	case req.After != nil:
+		messages, hasMore, err := messagesAfter(db, base, args, *req.After, req.Limit, false)
+		return messagePage{Messages: messages, HasMore: hasMore}, err
+
+	case req.Around != 0:
+		anchors, err := queryMessages(db, base+" AND m.id = ?", append(args, req.Around)...)
+		if err != nil {
+			return messagePage{}, err
+		}
+		if len(anchors) == 0 {
+			return messagePage{}, ErrAnchorNotFound
+		}
+		anchor := cursorOf(anchors[0])
+
+		// Half the page before the message, the message itself and the rest after it
+		older, hasMore, err := messagesBefore(db, base, args, &anchor, req.Limit/2)
+		if err != nil {
+			return messagePage{}, err
+		}
+		newer, _, err := messagesAfter(db, base, args, anchor, req.Limit-len(older), true)
+		if err != nil {
+			return messagePage{}, err
+		}
+		return messagePage{Messages: append(older, newer...), HasMore: hasMore}, nil
+
+	default:
+		messages, hasMore, err := messagesBefore(db, base, args, req.Before, req.Limit)
+		return messagePage{Messages: messages, HasMore: hasMore}, err
+	}
+}
+
+// messagesBefore returns up to limit messages older than cursor (or the
+// newest ones if cursor is nil), oldest first
+func messagesBefore(db *sql.DB, base string, args []interface{}, cursor *Cursor, limit int) ([]Message, bool, error) {
+	if limit < 1 {
+		return []Message{}, false, nil
+	}
+	query := base
+	if cursor != nil {
+		query += " AND (m.created_at < ? OR (m.created_at = ? AND m.id < ?))"
+		args = append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID)
+	}
+	query += " ORDER BY m.created_at DESC, m.id DESC LIMIT ?"
+
+	messages, err := queryMessages(db, query, append(args, limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, hasMore, nil
+}
+
+// messagesAfter returns up to limit messages newer than cursor, or starting
+// at it if inclusive, oldest first
+func messagesAfter(db *sql.DB, base string, args []interface{}, cursor Cursor, limit int, inclusive bool) ([]Message, bool, error) {
+	if limit < 1 {
+		return []Message{}, false, nil
+	}
+	op := ">"
+	if inclusive {
+		op = ">="
+	}
+	query := base + " AND (m.created_at > ? OR (m.created_at = ? AND m.id " + op + " ?))" +
+		" ORDER BY m.created_at ASC, m.id ASC LIMIT ?"
+
+	messages, err := queryMessages(db, query, append(args, cursor.CreatedAt, cursor.CreatedAt, cursor.ID, limit+1)...)
+	if err != nil {
+		return nil, false, err
+	}
+	hasMore := len(messages) > limit
+	if hasMore {
+		messages = messages[:limit]
+	}
+	return messages, hasMore, nil
+}
+
+func queryMessages(db *sql.DB, query string, args ...interface{}) ([]Message, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := []Message{}
+	for rows.Next() {
+		message, err := messaging.Scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		messages = append(messages, message)
+	}
+	return messages, rows.Err()
+}
+
+// cursorResponse builds the response of a cursor-paginated request. The
+// messages are in the order the endpoint returns them.
+func cursorResponse(messages []Message, hasMore bool, limit int) MessageHistoryResponse {
+	response := MessageHistoryResponse{Messages: messages, Limit: limit, HasMore: hasMore}
+	if len(messages) == 0 {
+		return response
+	}
+	oldest, newest := messages[0], messages[len(messages)-1]
+	if oldest.CreatedAt.After(newest.CreatedAt) || (oldest.CreatedAt.Equal(newest.CreatedAt) && oldest.ID > newest.ID) {
+		oldest, newest = newest, oldest
+	}
+	response.NextCursor = cursorOf(oldest).Encode()
+	response.PrevCursor = cursorOf(newest).Encode()
+	return response
+}
+
+// respondPageError answers a failed cursor request
+func respondPageError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	message := "Failed to fetch messages"
+	switch err {
+	case ErrInvalidCursor, ErrCursorConflict, ErrPageUnsupported:
+		status, message = http.StatusBadRequest, err.Error()
+	case ErrAnchorNotFound:
+		status, message = http.StatusNotFound, err.Error()
+	}
+	c.JSON(status, ApiResponse{
+		Success: false,
+		Error:   message,
+	})
+}
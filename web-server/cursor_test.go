@@ -0,0 +1,89 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCursorRoundTrip(t *testing.T) {
+	cursor := Cursor{CreatedAt: time.Date(2024, 5, 1, 12, 30, 0, 0, time.UTC), ID: 42}
+
+	got, err := DecodeCursor(cursor.Encode())
+	if err != nil {
+		t.Fatalf("DecodeCursor: %v", err)
+	}
+	if !got.CreatedAt.Equal(cursor.CreatedAt) || got.ID != cursor.ID {
+		t.Errorf("round trip = %+v, want %+v", got, cursor)
+	}
+
+	// Conversation cursors of groups without messages carry a negative ID
+	group := Cursor{CreatedAt: cursor.CreatedAt, ID: -7}
+	if got, err := DecodeCursor(group.Encode()); err != nil || got.ID != -7 {
+		t.Errorf("DecodeCursor(group cursor) = %+v, %v", got, err)
+	}
+
+	for _, bad := range []string{"", "not base64!", "MTIz", "YTpi", "MTA6MA"} {
+		if _, err := DecodeCursor(bad); err != ErrInvalidCursor {
+			t.Errorf("DecodeCursor(%q) error = %v, want ErrInvalidCursor", bad, err)
+		}
+	}
+}
+
+func TestParsePageRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	cursor := Cursor{CreatedAt: time.Unix(1700000000, 0), ID: 7}.Encode()
+
+	tests := []struct {
+		query string
+		err   error
+		check func(pageRequest) bool
+	}{
+		{"", nil, func(r pageRequest) bool { return r.Before == nil && r.Limit == 50 }},
+		{"?limit=10", nil, func(r pageRequest) bool { return r.Before == nil && r.Limit == 10 }},
+		{"?page=2&limit=10", errPageNumbered, nil},
+		{"?page=2&before=" + cursor, nil, func(r pageRequest) bool { return r.Before != nil && r.Before.ID == 7 }},
+		{"?before=" + cursor, nil, func(r pageRequest) bool { return r.Before != nil && r.Before.ID == 7 && r.Limit == 50 }},
+		{"?after=" + cursor + "&limit=20", nil, func(r pageRequest) bool { return r.After != nil && r.Limit == 20 }},
+		{"?around=15&limit=500", nil, func(r pageRequest) bool { return r.Around == 15 && r.Limit == 50 }},
+		{"?before=", nil, func(r pageRequest) bool { return r.Before == nil && r.After == nil && r.Around == 0 }},
+		{"?cursor=" + cursor, nil, func(r pageRequest) bool { return r.Before != nil && r.Before.ID == 7 }},
+		{"?before=" + cursor + "&around=3", ErrCursorConflict, nil},
+		{"?cursor=&before=" + cursor, ErrCursorConflict, nil},
+		{"?around=abc", ErrInvalidCursor, nil},
+		{"?after=garbage", ErrInvalidCursor, nil},
+	}
+
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("GET", "/messages"+tt.query, nil)
+
+		req, err := parsePageRequest(c)
+		if err != tt.err {
+			t.Errorf("%q: error = %v, want %v", tt.query, err, tt.err)
+			continue
+		}
+		if tt.check != nil && !tt.check(req) {
+			t.Errorf("%q: unexpected request %+v", tt.query, req)
+		}
+	}
+}
+
+func TestCursorResponseOrdersCursors(t *testing.T) {
+	older := Message{ID: 1, CreatedAt: time.Unix(100, 0)}
+	newer := Message{ID: 2, CreatedAt: time.Unix(100, 0)}
+
+	// History lists newest first, conversations oldest first; the cursors are the same
+	for _, messages := range [][]Message{{older, newer}, {newer, older}} {
+		response := cursorResponse(messages, true, 2)
+		if response.NextCursor != cursorOf(older).Encode() || response.PrevCursor != cursorOf(newer).Encode() {
+			t.Errorf("cursors for %v point the wrong way", messages)
+		}
+	}
+
+	if response := cursorResponse([]Message{}, false, 2); response.NextCursor != "" || response.PrevCursor != "" {
+		t.Errorf("empty page should have no cursors, got %+v", response)
+	}
+}
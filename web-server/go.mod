@@ -5,6 +5,8 @@ go 1.23.0
 toolchain go1.24.6
 
 require (
+	chatapp/auth v0.0.0
+	chatapp/messaging v0.0.0
 	github.com/gin-contrib/cors v1.7.6
 	github.com/gin-gonic/gin v1.10.1
 	github.com/go-sql-driver/mysql v1.9.3
@@ -46,3 +48,7 @@ require (
 	github.com/cloudwego/base64x v0.1.5 // indirect
 	github.com/knz/go-libedit v1.10.1 // indirect
 )
+
+replace chatapp/auth => ../auth
+
+replace chatapp/messaging => ../messaging
@@ -0,0 +1,495 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+// Roles within a group, stored in conversation_members.role
+const (
+	GroupRoleOwner  = "owner"
+	GroupRoleMember = "member"
+)
+
+var (
+	ErrNotGroupMember = messaging.ErrNotGroupMember
+	ErrNotGroupOwner  = errors.New("Only group owners can do that")
+)
+
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// GroupHandler manages group conversations. Every change to a group is pushed
+// to its members, and to anyone who just left it, as a group_updated event.
+type GroupHandler struct {
+	db     *sql.DB
+	outbox *Outbox
+}
+
+func NewGroupHandler(db *sql.DB, outbox *Outbox) *GroupHandler {
+	return &GroupHandler{db: db, outbox: outbox}
+}
+
+// CreateGroup creates a group owned by the caller with the given members
+func (h *GroupHandler) CreateGroup(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	var req CreateGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO conversations (name, created_by) VALUES (?, ?)", req.Name, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create group",
+		})
+		return
+	}
+	id, _ := result.LastInsertId()
+	groupID := int(id)
+
+	if _, err := tx.Exec(
+		"INSERT INTO conversation_members (conversation_id, user_id, role) VALUES (?, ?, ?)",
+		groupID, userID, GroupRoleOwner,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create group",
+		})
+		return
+	}
+
+	if err := addGroupMembers(tx, groupID, req.MemberIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to add members",
+		})
+		return
+	}
+
+	h.commitAndNotify(c, tx, groupID, nil, http.StatusCreated, "Group created")
+}
+
+// ListGroups returns the groups the caller is a member of, most recently changed first
+func (h *GroupHandler) ListGroups(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	rows, err := h.db.Query(`
+		SELECT c.id, c.name, c.created_by, c.created_at, c.updated_at,
+		       (SELECT COUNT(*) FROM conversation_members WHERE conversation_id = c.id)
+		FROM conversations c
+		JOIN conversation_members cm ON cm.conversation_id = c.id
+		WHERE cm.user_id = ?
+		ORDER BY c.updated_at DESC
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch groups",
+		})
+		return
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.Name, &group.CreatedBy, &group.CreatedAt, &group.UpdatedAt, &group.MemberCount); err != nil {
+			continue
+		}
+		groups = append(groups, group)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    GroupListResponse{Groups: groups},
+	})
+}
+
+// GetGroup returns a group with its members
+func (h *GroupHandler) GetGroup(c *gin.Context) {
+	groupID, ok := h.groupAccess(c, false)
+	if !ok {
+		return
+	}
+
+	group, err := loadGroup(h.db, groupID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to load group",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    group,
+	})
+}
+
+// RenameGroup changes a group's name. Owners only.
+func (h *GroupHandler) RenameGroup(c *gin.Context) {
+	var req RenameGroupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	groupID, ok := h.groupAccess(c, true)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE conversations SET name = ? WHERE id = ?", req.Name, groupID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to rename group",
+		})
+		return
+	}
+
+	h.commitAndNotify(c, tx, groupID, nil, http.StatusOK, "Group renamed")
+}
+
+// AddMembers adds users to a group. Owners only; existing members are skipped.
+func (h *GroupHandler) AddMembers(c *gin.Context) {
+	var req AddMembersRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	groupID, ok := h.groupAccess(c, true)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := addGroupMembers(tx, groupID, req.UserIDs); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to add members",
+		})
+		return
+	}
+
+	h.commitAndNotify(c, tx, groupID, nil, http.StatusOK, "Members added")
+}
+
+// RemoveMember removes a member from a group. Owners can remove members;
+// anyone can remove themselves, which is the same as leaving.
+func (h *GroupHandler) RemoveMember(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	memberID, err := strconv.Atoi(c.Param("user_id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid user ID",
+		})
+		return
+	}
+	if memberID == userID {
+		h.LeaveGroup(c)
+		return
+	}
+
+	groupID, ok := h.groupAccess(c, true)
+	if !ok {
+		return
+	}
+
+	role, err := groupRole(h.db, groupID, memberID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "User is not a member of this group",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if role == GroupRoleOwner {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Owners cannot be removed, they can only leave",
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?", groupID, memberID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to remove member",
+		})
+		return
+	}
+
+	h.commitAndNotify(c, tx, groupID, []int{memberID}, http.StatusOK, "Member removed")
+}
+
+// LeaveGroup removes the caller from a group. If the last owner leaves, the
+// longest-standing member becomes owner; if nobody is left, the group and
+// its history are deleted.
+func (h *GroupHandler) LeaveGroup(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	groupID, ok := h.groupAccess(c, false)
+	if !ok {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM conversation_members WHERE conversation_id = ? AND user_id = ?", groupID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to leave group",
+		})
+		return
+	}
+
+	var members, owners int
+	if err := tx.QueryRow(
+		"SELECT COUNT(*), COALESCE(SUM(role = 'owner'), 0) FROM conversation_members WHERE conversation_id = ?",
+		groupID,
+	).Scan(&members, &owners); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	var updateErr error
+	if members == 0 {
+		_, updateErr = tx.Exec("DELETE FROM conversations WHERE id = ?", groupID)
+	} else if owners == 0 {
+		_, updateErr = tx.Exec(
+			"UPDATE conversation_members SET role = ? WHERE conversation_id = ? ORDER BY joined_at, user_id LIMIT 1",
+			GroupRoleOwner, groupID,
+		)
+	}
+	if updateErr != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to leave group",
+		})
+		return
+	}
+
+	h.commitAndNotify(c, tx, groupID, []int{userID}, http.StatusOK, "Left group")
+}
+
+// groupAccess resolves the :id parameter to a group the caller belongs to
+// (and owns, if ownerOnly), answering the request itself if not
+func (h *GroupHandler) groupAccess(c *gin.Context, ownerOnly bool) (int, bool) {
+	userID, _, _ := GetUserFromContext(c)
+
+	groupID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid group ID",
+		})
+		return 0, false
+	}
+
+	role, err := groupRole(h.db, groupID, userID)
+	if err == sql.ErrNoRows {
+		// Non-members cannot tell a group they are not in from one that does not exist
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Group not found",
+		})
+		return 0, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return 0, false
+	}
+	if ownerOnly && role != GroupRoleOwner {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   ErrNotGroupOwner.Error(),
+		})
+		return 0, false
+	}
+	return groupID, true
+}
+
+// commitAndNotify queues a group_updated event for the group's members and
+// formerMembers, commits, and responds with the group as it now stands
+func (h *GroupHandler) commitAndNotify(c *gin.Context, tx *sql.Tx, groupID int, formerMembers []int, status int, message string) {
+	group, err := loadGroup(tx, groupID)
+	if err == sql.ErrNoRows {
+		// The last member left and the group was deleted
+		group = Group{ID: groupID, Members: []GroupMember{}}
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to load group",
+		})
+		return
+	}
+
+	userIDs := append([]int{}, formerMembers...)
+	for _, member := range group.Members {
+		userIDs = append(userIDs, member.UserID)
+	}
+	if err := h.outbox.Enqueue(tx, GroupUpdatedNotification(group, userIDs)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue group notification",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to commit transaction",
+		})
+		return
+	}
+	h.outbox.Wake()
+
+	c.JSON(status, ApiResponse{
+		Success: true,
+		Message: message,
+		Data:    group,
+	})
+}
+
+// groupRole returns the user's role in the group, or sql.ErrNoRows if they are not a member
+func groupRole(db queryer, groupID, userID int) (string, error) {
+	var role string
+	err := db.QueryRow(
+		"SELECT role FROM conversation_members WHERE conversation_id = ? AND user_id = ?",
+		groupID, userID,
+	).Scan(&role)
+	return role, err
+}
+
+// addGroupMembers adds existing users to the group, skipping current members and unknown IDs
+func addGroupMembers(tx *sql.Tx, groupID int, userIDs []int) error {
+	for _, userID := range userIDs {
+		if _, err := tx.Exec(
+			"INSERT IGNORE INTO conversation_members (conversation_id, user_id, role) SELECT ?, id, ? FROM users WHERE id = ?",
+			groupID, GroupRoleMember, userID,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadGroup reads a group with its members, owners first
+func loadGroup(db queryer, groupID int) (Group, error) {
+	var group Group
+	err := db.QueryRow(
+		"SELECT id, name, created_by, created_at, updated_at FROM conversations WHERE id = ?",
+		groupID,
+	).Scan(&group.ID, &group.Name, &group.CreatedBy, &group.CreatedAt, &group.UpdatedAt)
+	if err != nil {
+		return group, err
+	}
+
+	rows, err := db.Query(`
+		SELECT cm.user_id, u.username, u.avatar_url, cm.role, cm.joined_at
+		FROM conversation_members cm
+		JOIN users u ON cm.user_id = u.id
+		WHERE cm.conversation_id = ?
+		ORDER BY cm.role = 'owner' DESC, cm.joined_at, cm.user_id
+	`, groupID)
+	if err != nil {
+		return group, err
+	}
+	defer rows.Close()
+
+	group.Members = []GroupMember{}
+	for rows.Next() {
+		var member GroupMember
+		if err := rows.Scan(&member.UserID, &member.Username, &member.AvatarURL, &member.Role, &member.JoinedAt); err != nil {
+			return group, err
+		}
+		group.Members = append(group.Members, member)
+	}
+	group.MemberCount = len(group.Members)
+	return group, rows.Err()
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"chatapp/auth"
+	"github.com/gin-gonic/gin"
+)
+
+var signingKeys *auth.KeySet
+
+// InitSigningKeys loads the JWT signing keys from JWT_KEYS_DIR. JWT_ACTIVE_KID
+// selects the key for new tokens; older keys keep verifying the tokens they
+// signed. An empty directory gets a freshly generated Ed25519 key.
+func InitSigningKeys() error {
+	dir := getEnvOrDefault("JWT_KEYS_DIR", "./keys")
+	activeID := getEnvOrDefault("JWT_ACTIVE_KID", "")
+
+	keys, err := auth.LoadKeySet(dir, activeID)
+	if errors.Is(err, auth.ErrNoKeys) {
+		kid, genErr := auth.GenerateKeyFile(dir, auth.AlgEdDSA)
+		if genErr != nil {
+			return genErr
+		}
+		log.Printf("No JWT signing keys in %s, generated %s", dir, kid)
+		keys, err = auth.LoadKeySet(dir, activeID)
+	}
+	if err != nil {
+		return err
+	}
+
+	signingKeys = keys
+	log.Printf("Loaded JWT signing keys from %s", dir)
+	return nil
+}
+
+// ReloadSigningKeys re-reads JWT_KEYS_DIR after a key rotation
+func ReloadSigningKeys() error {
+	return signingKeys.LoadDir(
+		getEnvOrDefault("JWT_KEYS_DIR", "./keys"),
+		getEnvOrDefault("JWT_ACTIVE_KID", ""),
+	)
+}
+
+// JWKS publishes the public signing keys so other services can verify tokens
+func JWKS(c *gin.Context) {
+	c.JSON(http.StatusOK, signingKeys.JWKS())
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail is a plain-text email
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers transactional email such as password reset links
+type Mailer interface {
+	Send(mail Mail) error
+}
+
+// NewMailer picks an implementation from MAIL_DRIVER: "smtp", "file" (the
+// default, writing .eml files to MAIL_DIR) or "memory"
+func NewMailer() Mailer {
+	from := getEnvOrDefault("MAIL_FROM", "ChatApp <no-reply@chatapp.local>")
+
+	switch driver := getEnvOrDefault("MAIL_DRIVER", "file"); driver {
+	case "smtp":
+		return NewSMTPMailer(
+			getEnvOrDefault("SMTP_HOST", "localhost"),
+			getEnvOrDefault("SMTP_PORT", "25"),
+			getEnvOrDefault("SMTP_USERNAME", ""),
+			getEnvOrDefault("SMTP_PASSWORD", ""),
+			from,
+		)
+	case "memory":
+		return &MemoryMailer{}
+	default:
+		if driver != "file" {
+			log.Printf("Unknown MAIL_DRIVER %q, writing mail to files", driver)
+		}
+		return &FileMailer{Dir: getEnvOrDefault("MAIL_DIR", "./mail"), From: from}
+	}
+}
+
+// SMTPMailer sends mail through an SMTP server. Authentication is only used
+// when a username is configured, so local catchers like MailHog work as is.
+type SMTPMailer struct {
+	addr string
+	host string
+	auth smtp.Auth
+	from string
+}
+
+func NewSMTPMailer(host, port, username, password, from string) *SMTPMailer {
+	m := &SMTPMailer{addr: host + ":" + port, host: host, from: from}
+	if username != "" {
+		m.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return m
+}
+
+func (m *SMTPMailer) Send(mail Mail) error {
+	return smtp.SendMail(m.addr, m.auth, envelopeAddress(m.from), []string{mail.To}, formatMail(m.from, mail))
+}
+
+// FileMailer writes every message to its own .eml file instead of sending it
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(mail Mail) error {
+	if err := os.MkdirAll(m.Dir, 0755); err != nil {
+		return err
+	}
+	recipient := strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' {
+			return '_'
+		}
+		return r
+	}, mail.To)
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), recipient)
+	return os.WriteFile(filepath.Join(m.Dir, name), formatMail(m.From, mail), 0644)
+}
+
+// MemoryMailer keeps sent mail in memory, for tests
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func (m *MemoryMailer) Send(mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// Sent returns a copy of every message sent so far
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]Mail(nil), m.sent...)
+}
+
+func formatMail(from string, mail Mail) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", mail.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", mail.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(mail.Body, "\n", "\r\n"))
+	return []byte(b.String())
+}
+
+// envelopeAddress extracts the bare address from "Name <addr>"
+func envelopeAddress(from string) string {
+	if start := strings.LastIndex(from, "<"); start != -1 {
+		if end := strings.LastIndex(from, ">"); end > start {
+			return from[start+1 : end]
+		}
+	}
+	return from
+}
@@ -3,6 +3,10 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
@@ -14,17 +18,51 @@ func main() {
 	}
 	defer CloseDB()
 
+	if err := InitSigningKeys(); err != nil {
+		log.Fatal("Failed to load JWT signing keys:", err)
+	}
+
+	// Reload signing keys on SIGHUP so keys can be rotated without a restart
+	go func() {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		for range hup {
+			if err := ReloadSigningKeys(); err != nil {
+				log.Printf("Failed to reload JWT signing keys: %v", err)
+			} else {
+				log.Println("Reloaded JWT signing keys")
+			}
+		}
+	}()
 
 	r := gin.Default()
 
-	authHandler := NewAuthHandler(GetDB())
-	messageHandler := NewMessageHandler(GetDB())
-	mediaHandler := NewMediaHandler()
+	outbox := NewOutbox(GetDB())
+	go outbox.Run()
+
+	sessions := NewSessions(GetDB(), outbox)
+	tokens := NewAccessTokens(GetDB())
+
+	throttle := NewLoginThrottle(NewMemoryAttemptStore(parseDurationEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute)))
+
+	resets := NewResetThrottle(NewMemoryAttemptStore(parseDurationEnv("RESET_REQUEST_WINDOW", time.Hour)))
+
+	authHandler := NewAuthHandler(GetDB(), sessions, NewMailer(), throttle, resets)
+	verification := NewVerificationPolicy(GetDB())
+
+	messageHandler := NewMessageHandler(GetDB(), outbox, verification)
+	mediaHandler := NewMediaHandler(GetDB())
+	adminHandler := NewAdminHandler(GetDB(), outbox, sessions)
+	sessionHandler := NewSessionHandler(sessions)
+	mfaHandler := NewMFAHandler(GetDB(), authHandler)
+	tokenHandler := NewTokenHandler(GetDB(), tokens)
+	groupHandler := NewGroupHandler(GetDB(), outbox)
+	channelHandler := NewChannelHandler(GetDB(), outbox)
 
 	// Configure CORS
 	config := cors.DefaultConfig()
 	config.AllowOrigins = []string{"http://localhost:3000", "http://localhost:8080", "*"}
-	config.AllowMethods = []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"}
+	config.AllowMethods = []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
 	config.AllowHeaders = []string{"Origin", "Content-Type", "Authorization"}
 	config.AllowCredentials = true
 	r.Use(cors.New(config))
@@ -37,6 +75,9 @@ func main() {
 		})
 	})
 
+	// Public keys for verifying access tokens
+	r.GET("/.well-known/jwks.json", JWKS)
+
 	// Root endpoint to redirect to frontend
 	r.GET("/", func(c *gin.Context) {
 		c.JSON(http.StatusOK, ApiResponse{
@@ -57,22 +98,101 @@ func main() {
 		{
 			auth.POST("/register", authHandler.Register)
 			auth.POST("/login", authHandler.Login)
+			auth.POST("/mfa", authHandler.VerifyMFA)
+			auth.POST("/refresh", authHandler.Refresh)
+			auth.POST("/logout", authHandler.Logout)
+			auth.POST("/forgot-password", authHandler.ForgotPassword)
+			auth.POST("/reset-password", authHandler.ResetPassword)
+			auth.POST("/verify-email", authHandler.VerifyEmail)
+			auth.POST("/resend-verification", AuthMiddleware(sessions, tokens), RequireScope(ScopeAccount), authHandler.ResendVerification)
 		}
 
-		// Protected routes
+		// Protected routes, split by the scope a personal access token needs.
+		// Logged-in sessions hold every scope.
 		protected := api.Group("/")
-		protected.Use(AuthMiddleware())
+		protected.Use(AuthMiddleware(sessions, tokens))
 		{
-			protected.GET("/profile", authHandler.GetProfile)
-			protected.GET("/users", authHandler.GetUsers)
-
-			protected.POST("/messages", messageHandler.SendMessage)
-			protected.GET("/messages", messageHandler.GetMessageHistory)
-			protected.GET("/conversations/:user_id", messageHandler.GetConversation)
-			protected.PUT("/messages/read", messageHandler.MarkAsRead)
+			profile := protected.Group("/", RequireScope(ScopeProfileRead))
+			profile.GET("/profile", authHandler.GetProfile)
+
+			profileWrite := protected.Group("/", RequireScope(ScopeProfileWrite))
+			profileWrite.PATCH("/profile", authHandler.UpdateProfile)
+			profileWrite.POST("/profile/avatar", mediaHandler.UploadAvatar)
+			profileWrite.DELETE("/profile/avatar", mediaHandler.DeleteAvatar)
+
+			users := protected.Group("/", RequireScope(ScopeUsersRead))
+			users.GET("/users", authHandler.GetUsers)
+
+			messagesRead := protected.Group("/", RequireScope(ScopeMessagesRead))
+			messagesRead.GET("/messages", messageHandler.GetMessageHistory)
+			messagesRead.GET("/conversations/:user_id", messageHandler.GetConversation)
+			messagesRead.GET("/messages/:id/receipts", messageHandler.GetReadReceipts)
+			messagesRead.GET("/conversations", messageHandler.ListConversations)
+			messagesRead.GET("/groups", groupHandler.ListGroups)
+			messagesRead.GET("/groups/:id", groupHandler.GetGroup)
+			messagesRead.GET("/groups/:id/messages", messageHandler.GetGroupConversation)
+			messagesRead.GET("/channels", channelHandler.ListChannels)
+			messagesRead.GET("/channels/:id", channelHandler.GetChannel)
+			messagesRead.GET("/channels/:id/messages", messageHandler.GetChannelMessages)
+
+			messagesWrite := protected.Group("/", RequireScope(ScopeMessagesWrite))
+			messagesWrite.POST("/messages", messageHandler.SendMessage)
+			messagesWrite.PUT("/messages/read", messageHandler.MarkAsRead)
+			messagesWrite.PATCH("/messages/:id", messageHandler.EditMessage)
+			messagesWrite.POST("/groups", groupHandler.CreateGroup)
+			messagesWrite.PATCH("/groups/:id", groupHandler.RenameGroup)
+			messagesWrite.POST("/groups/:id/members", groupHandler.AddMembers)
+			messagesWrite.DELETE("/groups/:id/members/:user_id", groupHandler.RemoveMember)
+			messagesWrite.POST("/groups/:id/leave", groupHandler.LeaveGroup)
+			messagesWrite.POST("/channels", channelHandler.CreateChannel)
+			messagesWrite.POST("/channels/:id/join", channelHandler.JoinChannel)
+			messagesWrite.POST("/channels/:id/leave", channelHandler.LeaveChannel)
+			messagesWrite.PUT("/channels/:id/read", channelHandler.MarkChannelRead)
+
+			mediaRead := protected.Group("/", RequireScope(ScopeMediaRead))
+			mediaRead.GET("/media", mediaHandler.GetUserMedia)
+
+			mediaWrite := protected.Group("/", RequireScope(ScopeMediaWrite))
+			mediaWrite.POST("/media/upload", verification.Require(ActionMedia), mediaHandler.UploadMedia)
+
+			account := protected.Group("/", RequireScope(ScopeAccount))
+			account.PUT("/profile/password", authHandler.ChangePassword)
+
+			account.GET("/sessions", sessionHandler.ListSessions)
+			account.DELETE("/sessions/:id", sessionHandler.RevokeSession)
+			account.DELETE("/sessions", sessionHandler.RevokeOtherSessions)
+
+			account.POST("/mfa/enroll", mfaHandler.Enroll)
+			account.POST("/mfa/confirm", mfaHandler.Confirm)
+			account.POST("/mfa/recovery-codes", mfaHandler.RegenerateRecoveryCodes)
+			account.POST("/mfa/disable", mfaHandler.Disable)
+
+			account.GET("/tokens", tokenHandler.ListTokens)
+			account.POST("/tokens", tokenHandler.CreateToken)
+			account.DELETE("/tokens/:id", tokenHandler.RevokeToken)
+
+			account.GET("/bots", tokenHandler.ListBots)
+			account.POST("/bots", tokenHandler.CreateBot)
+			account.GET("/bots/:id/tokens", tokenHandler.ListBotTokens)
+			account.POST("/bots/:id/tokens", tokenHandler.CreateBotToken)
+		}
 
-			protected.POST("/media/upload", mediaHandler.UploadMedia)
-			protected.GET("/media", mediaHandler.GetUserMedia)
+		admin := api.Group("/admin")
+		admin.Use(AuthMiddleware(sessions, tokens), RequireScope(ScopeAccount))
+		{
+			moderator := admin.Group("/", RequireRole(RoleModerator))
+			moderator.GET("/users", adminHandler.ListUsers)
+			moderator.POST("/users/:id/suspend", adminHandler.SuspendUser)
+			moderator.POST("/users/:id/unsuspend", adminHandler.UnsuspendUser)
+			moderator.DELETE("/messages/:id", adminHandler.DeleteMessage)
+			moderator.GET("/messages/:id/revisions", adminHandler.GetMessageRevisions)
+
+			admins := admin.Group("/", RequireRole(RoleAdmin))
+			admins.PUT("/users/:id/role", adminHandler.SetUserRole)
+			admins.GET("/broadcast-policy", adminHandler.GetBroadcastPolicy)
+			admins.PUT("/broadcast-policy", adminHandler.SetBroadcastPolicy)
+			admins.GET("/outbox", adminHandler.ListOutbox)
+			admins.POST("/outbox/:id/retry", adminHandler.RetryOutbox)
 		}
 
 		api.GET("/media/:user_dir/:filename", mediaHandler.ServeMedia)
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"io"
 	"net/http"
@@ -13,17 +14,18 @@ import (
 )
 
 type MediaHandler struct {
+	db        *sql.DB
 	uploadDir string
 }
 
-func NewMediaHandler() *MediaHandler {
+func NewMediaHandler(db *sql.DB) *MediaHandler {
 	uploadDir := getEnvOrDefault("UPLOAD_DIR", "./uploads")
 	
 	if err := os.MkdirAll(uploadDir, 0755); err != nil {
 		panic(fmt.Sprintf("Failed to create upload directory: %v", err))
 	}
 	
-	return &MediaHandler{uploadDir: uploadDir}
+	return &MediaHandler{db: db, uploadDir: uploadDir}
 }
 
 func (h *MediaHandler) UploadMedia(c *gin.Context) {
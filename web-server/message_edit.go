@@ -0,0 +1,163 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"chatapp/messaging"
+	"github.com/gin-gonic/gin"
+)
+
+// editWindowOpen reports whether a message sent at sentAt may still be edited
+func editWindowOpen(sentAt, now time.Time, window time.Duration) bool {
+	return now.Sub(sentAt) <= window
+}
+
+// EditMessage replaces the content of one of the caller's messages, keeping
+// the previous content as a revision
+func (h *MessageHandler) EditMessage(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid message ID",
+		})
+		return
+	}
+
+	var req EditMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	// Both timestamps come from the database so the window does not depend
+	// on the two clocks agreeing
+	var senderID int
+	var content string
+	var sentAt, now time.Time
+	err = tx.QueryRow(
+		"SELECT sender_id, content, created_at, NOW() FROM messages WHERE id = ? FOR UPDATE", messageID,
+	).Scan(&senderID, &content, &sentAt, &now)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Message not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	if senderID != userID {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Only the sender can edit this message",
+		})
+		return
+	}
+	if !editWindowOpen(sentAt, now, h.editWindow) {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "This message can no longer be edited",
+		})
+		return
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO message_revisions (message_id, content, edited_by) VALUES (?, ?, ?)",
+		messageID, content, userID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to save revision",
+		})
+		return
+	}
+	if _, err := tx.Exec(
+		"UPDATE messages SET content = ?, edited_at = NOW() WHERE id = ?", req.Content, messageID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to edit message",
+		})
+		return
+	}
+
+	message, err := messaging.Load(tx, messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to retrieve message details",
+		})
+		return
+	}
+
+	recipientIDs, err := messaging.Recipients(tx, messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	// Channel messages have no recipients; the WebSocket server pushes the
+	// edit to the channel's subscribers instead
+	var userIDs []int
+	if message.ChannelID == nil {
+		userIDs = append([]int{message.SenderID}, recipientIDs...)
+	}
+	if err := h.outbox.Enqueue(tx, MessageEditedNotification(message, userIDs)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue notification",
+		})
+		return
+	}
+	// The edited message may be the conversation's last message
+	if err := enqueueConversationUpdates(tx, h.outbox, messaging.ConversationKeys(message, recipientIDs)); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue conversation updates",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to edit message",
+		})
+		return
+	}
+	h.outbox.Wake()
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Message updated",
+		Data:    message,
+	})
+}
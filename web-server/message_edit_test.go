@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEditWindowOpen(t *testing.T) {
+	sentAt := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	window := 15 * time.Minute
+
+	tests := []struct {
+		now  time.Time
+		want bool
+	}{
+		{sentAt, true},
+		{sentAt.Add(10 * time.Minute), true},
+		{sentAt.Add(window), true},
+		{sentAt.Add(window + time.Second), false},
+		{sentAt.Add(24 * time.Hour), false},
+	}
+	for _, tt := range tests {
+		if got := editWindowOpen(sentAt, tt.now, window); got != tt.want {
+			t.Errorf("editWindowOpen(%v) = %v, want %v", tt.now.Sub(sentAt), got, tt.want)
+		}
+	}
+}
@@ -2,23 +2,36 @@ package main
 
 import (
 	"database/sql"
+	"errors"
+	"log"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
+	"chatapp/messaging"
 	"github.com/gin-gonic/gin"
 )
 
 type MessageHandler struct {
-	db *sql.DB
+	db           *sql.DB
+	outbox       *Outbox
+	verification *VerificationPolicy
+	// editWindow is how long after sending a message its sender may edit it
+	editWindow time.Duration
 }
 
-func NewMessageHandler(db *sql.DB) *MessageHandler {
-	return &MessageHandler{db: db}
+func NewMessageHandler(db *sql.DB, outbox *Outbox, verification *VerificationPolicy) *MessageHandler {
+	return &MessageHandler{
+		db:           db,
+		outbox:       outbox,
+		verification: verification,
+		editWindow:   parseDurationEnv("MESSAGE_EDIT_WINDOW", 15*time.Minute),
+	}
 }
 
 func (h *MessageHandler) SendMessage(c *gin.Context) {
-	var req SendMessageRequest
+	var req messaging.SendRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, ApiResponse{
 			Success: false,
@@ -29,19 +42,12 @@ func (h *MessageHandler) SendMessage(c *gin.Context) {
 
 	senderID, _, _ := GetUserFromContext(c)
 
-	if req.MessageType != "direct" && req.MessageType != "broadcast" {
-		c.JSON(http.StatusBadRequest, ApiResponse{
-			Success: false,
-			Error:   "Invalid message type. Must be 'direct' or 'broadcast'",
-		})
+	if err := req.Validate(); err != nil {
+		respondSendError(c, err)
 		return
 	}
-
-	if req.MessageType == "direct" && len(req.Recipients) == 0 {
-		c.JSON(http.StatusBadRequest, ApiResponse{
-			Success: false,
-			Error:   "Recipients required for direct messages",
-		})
+	if err := messaging.Authorize(h.db, senderID, req, h.verification.restricted); err != nil {
+		respondSendError(c, err)
 		return
 	}
 
@@ -55,94 +61,39 @@ func (h *MessageHandler) SendMessage(c *gin.Context) {
 	}
 	defer tx.Rollback()
 
-	result, err := tx.Exec(
-		"INSERT INTO messages (sender_id, content, message_type, media_url, media_type) VALUES (?, ?, ?, ?, ?)",
-		senderID, req.Content, req.MessageType, req.MediaURL, req.MediaType,
-	)
+	message, recipientIDs, err := messaging.Send(tx, senderID, req)
 	if err != nil {
+		log.Printf("Failed to send message from user %d: %v", senderID, err)
+		respondSendError(c, err)
+		return
+	}
+
+	// Notify WebSocket server about the new message once the transaction commits
+	// Channel messages have no recipient list; the WebSocket server pushes
+	// them to the channel's subscribers instead
+	if err := h.outbox.Enqueue(tx, NewMessageNotification(message, recipientIDs)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
-			Error:   "Failed to create message",
+			Error:   "Failed to queue message notification",
 		})
 		return
 	}
-
-	messageID, _ := result.LastInsertId()
-
-	if req.MessageType == "direct" {
-		for _, recipientID := range req.Recipients {
-			_, err := tx.Exec(
-				"INSERT INTO message_recipients (message_id, recipient_id) VALUES (?, ?)",
-				messageID, recipientID,
-			)
-			if err != nil {
-				c.JSON(http.StatusInternalServerError, ApiResponse{
-					Success: false,
-					Error:   "Failed to add recipients",
-				})
-				return
-			}
-		}
-	} else {
-		_, err := tx.Exec(
-			"INSERT INTO message_recipients (message_id, recipient_id) SELECT ?, id FROM users WHERE id != ?",
-			messageID, senderID,
-		)
-		if err != nil {
-			c.JSON(http.StatusInternalServerError, ApiResponse{
-				Success: false,
-				Error:   "Failed to add broadcast recipients",
-			})
-			return
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
+	if err := enqueueConversationUpdates(tx, h.outbox, messaging.ConversationKeys(message, recipientIDs)); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
-			Error:   "Failed to send message",
+			Error:   "Failed to queue conversation updates",
 		})
 		return
 	}
 
-	// Get the created message with sender info
-	var message Message
-	err = h.db.QueryRow(`
-		SELECT m.id, m.sender_id, m.content, m.message_type, m.media_url, m.media_type, m.created_at, u.username
-		FROM messages m
-		JOIN users u ON m.sender_id = u.id
-		WHERE m.id = ?
-	`, messageID).Scan(
-		&message.ID, &message.SenderID, &message.Content, &message.MessageType,
-		&message.MediaURL, &message.MediaType, &message.CreatedAt, &message.SenderUsername,
-	)
-
-	if err != nil {
+	if err := tx.Commit(); err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
-			Error:   "Message sent but failed to retrieve details",
+			Error:   "Failed to send message",
 		})
 		return
 	}
-
-	// Notify WebSocket server about the new message
-	var recipientIDs []int
-	if req.MessageType == "direct" {
-		recipientIDs = req.Recipients
-	} else {
-		rows, err := h.db.Query("SELECT id FROM users WHERE id != ?", senderID)
-		if err == nil {
-			defer rows.Close()
-			for rows.Next() {
-				var userID int
-				if err := rows.Scan(&userID); err == nil {
-					recipientIDs = append(recipientIDs, userID)
-				}
-			}
-		}
-	}
-
-	go NotifyWebSocketServer(message, recipientIDs)
+	h.outbox.Wake()
 
 	c.JSON(http.StatusCreated, ApiResponse{
 		Success: true,
@@ -151,24 +102,36 @@ func (h *MessageHandler) SendMessage(c *gin.Context) {
 	})
 }
 
-func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
-	userID, _, _ := GetUserFromContext(c)
-
-	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
-	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
-	messageType := c.Query("type") // "direct", "broadcast", or empty for all
-
-	if page < 1 {
-		page = 1
+// respondSendError answers a send that the shared message rules refused, or
+// that failed in the database
+func respondSendError(c *gin.Context, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, messaging.ErrNotGroupMember), errors.Is(err, messaging.ErrChannelNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, messaging.ErrNotChannelMember), errors.Is(err, messaging.ErrBroadcastNotAllowed),
+		errors.Is(err, messaging.ErrEmailNotVerified):
+		status = http.StatusForbidden
+	case messaging.Rejected(err):
+		status = http.StatusBadRequest
 	}
-	if limit < 1 || limit > 100 {
-		limit = 50
+
+	message := "Failed to send message"
+	if status != http.StatusInternalServerError {
+		message = err.Error()
 	}
+	c.JSON(status, ApiResponse{
+		Success: false,
+		Error:   message,
+	})
+}
 
-	offset := (page - 1) * limit
+func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+	messageType := c.Query("type") // "direct", "broadcast", "group", or empty for all
 
 	query := `
-		SELECT DISTINCT m.id, m.sender_id, m.content, m.message_type, m.media_url, m.media_type, m.created_at, u.username
+		SELECT DISTINCT ` + messaging.Columns + `
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
 		LEFT JOIN message_recipients mr ON m.id = mr.message_id
@@ -182,60 +145,71 @@ func (h *MessageHandler) GetMessageHistory(c *gin.Context) {
 		args = append(args, messageType)
 	}
 
-	query += " ORDER BY m.created_at DESC LIMIT ? OFFSET ?"
-	args = append(args, limit, offset)
+	req, err := parsePageRequest(c)
+	if err == errPageNumbered {
+		h.getMessageHistoryPage(c, query, args)
+		return
+	}
+	if err != nil {
+		respondPageError(c, err)
+		return
+	}
 
-	rows, err := h.db.Query(query, args...)
+	page, err := fetchMessagePage(h.db, query, args, req)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ApiResponse{
-			Success: false,
-			Error:   "Failed to fetch message history",
-		})
+		respondPageError(c, err)
 		return
 	}
-	defer rows.Close()
 
-	var messages []Message
-	for rows.Next() {
-		var message Message
-		err := rows.Scan(
-			&message.ID, &message.SenderID, &message.Content, &message.MessageType,
-			&message.MediaURL, &message.MediaType, &message.CreatedAt, &message.SenderUsername,
-		)
-		if err != nil {
-			continue
-		}
-		messages = append(messages, message)
+	// newest first
+	messages := page.Messages
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
 	}
 
-	countQuery := `
-		SELECT COUNT(DISTINCT m.id)
-		FROM messages m
-		LEFT JOIN message_recipients mr ON m.id = mr.message_id
-		WHERE (mr.recipient_id = ? OR m.sender_id = ?)
-	`
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    cursorResponse(messages, page.HasMore, req.Limit),
+	})
+}
 
-	countArgs := []interface{}{userID, userID}
+// getMessageHistoryPage serves history requests that pass ?page= the way they
+// always were: page-numbered, with the total count
+func (h *MessageHandler) getMessageHistoryPage(c *gin.Context, query string, args []interface{}) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
 
-	if messageType != "" {
-		countQuery += " AND m.message_type = ?"
-		countArgs = append(countArgs, messageType)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 50
+	}
+
+	offset := (page - 1) * limit
+
+	messages, err := queryMessages(h.db, query+" ORDER BY m.created_at DESC, m.id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch message history",
+		})
+		return
 	}
 
 	var total int
-	err = h.db.QueryRow(countQuery, countArgs...).Scan(&total)
+	err = h.db.QueryRow("SELECT COUNT(*) FROM ("+query+") counted", args...).Scan(&total)
 	if err != nil {
 		total = 0
 	}
 
+	response := cursorResponse(messages, offset+len(messages) < total, limit)
+	response.Total = &total
+	response.Page = page
+
 	c.JSON(http.StatusOK, ApiResponse{
 		Success: true,
-		Data: MessageHistoryResponse{
-			Messages: messages,
-			Total:    total,
-			Page:     page,
-			Limit:    limit,
-		},
+		Data:    response,
 	})
 }
 
@@ -252,6 +226,30 @@ func (h *MessageHandler) GetConversation(c *gin.Context) {
 		return
 	}
 
+	query := `
+		SELECT ` + messaging.Columns + `
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		JOIN message_recipients mr ON m.id = mr.message_id
+		WHERE m.message_type = 'direct' 
+		AND (
+			(m.sender_id = ? AND mr.recipient_id = ?) OR 
+			(m.sender_id = ? AND mr.recipient_id = ?)
+		)
+	`
+	args := []interface{}{userID, otherUserID, otherUserID, userID}
+
+	req, err := parsePageRequest(c)
+	if err == errPageNumbered {
+		h.getConversationPage(c, query, args)
+		return
+	}
+	h.respondCursorPage(c, query, args, req, err)
+}
+
+// getConversationPage serves direct conversation requests that pass ?page=
+// the way they always were: a plain array, oldest first
+func (h *MessageHandler) getConversationPage(c *gin.Context, query string, args []interface{}) {
 	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
 	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
 
@@ -264,55 +262,138 @@ func (h *MessageHandler) GetConversation(c *gin.Context) {
 
 	offset := (page - 1) * limit
 
+	messages, err := queryMessages(h.db, query+" ORDER BY m.created_at DESC, m.id DESC LIMIT ? OFFSET ?", append(args, limit, offset)...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch conversation",
+		})
+		return
+	}
+
+	// order to show oldest first
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    messages,
+	})
+}
+
+// GetGroupConversation returns a group's messages, oldest first. Only current
+// members can read a group's history.
+func (h *MessageHandler) GetGroupConversation(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	groupID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid group ID",
+		})
+		return
+	}
+	if !h.requireMember(c, groupID, userID) {
+		return
+	}
+
 	query := `
-		SELECT m.id, m.sender_id, m.content, m.message_type, m.media_url, m.media_type, m.created_at, u.username
+		SELECT ` + messaging.Columns + `
 		FROM messages m
 		JOIN users u ON m.sender_id = u.id
-		JOIN message_recipients mr ON m.id = mr.message_id
-		WHERE m.message_type = 'direct' 
-		AND (
-			(m.sender_id = ? AND mr.recipient_id = ?) OR 
-			(m.sender_id = ? AND mr.recipient_id = ?)
-		)
-		ORDER BY m.created_at DESC
-		LIMIT ? OFFSET ?
+		WHERE m.conversation_id = ?
 	`
+	h.respondCursorOnly(c, query, []interface{}{groupID})
+}
 
-	rows, err := h.db.Query(query, userID, otherUserID, otherUserID, userID, limit, offset)
-	if err != nil {
-		c.JSON(http.StatusOK, ApiResponse{
-			Success: true,
-			Data:    []Message{},
-			Message: "No Conversation found",
+// GetChannelMessages returns a channel's messages, oldest first. Channels are
+// public, so their history can be read before joining.
+func (h *MessageHandler) GetChannelMessages(c *gin.Context) {
+	channelID, ok := channelIDParam(c)
+	if !ok {
+		return
+	}
+
+	var exists bool
+	if err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM channels WHERE id = ?)", channelID).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Channel not found",
 		})
 		return
 	}
-	defer rows.Close()
 
-	var messages []Message
-	for rows.Next() {
-		var message Message
-		err := rows.Scan(
-			&message.ID, &message.SenderID, &message.Content, &message.MessageType,
-			&message.MediaURL, &message.MediaType, &message.CreatedAt, &message.SenderUsername,
-		)
-		if err != nil {
-			continue
-		}
-		messages = append(messages, message)
+	query := `
+		SELECT ` + messaging.Columns + `
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		WHERE m.channel_id = ?
+	`
+	h.respondCursorOnly(c, query, []interface{}{channelID})
+}
+
+// respondCursorPage answers a message listing with a MessageHistoryResponse,
+// oldest message first, given the result of parsePageRequest
+func (h *MessageHandler) respondCursorPage(c *gin.Context, query string, args []interface{}, req pageRequest, err error) {
+	if err != nil {
+		respondPageError(c, err)
+		return
 	}
 
-	// order to show oldest first
-	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
-		messages[i], messages[j] = messages[j], messages[i]
+	page, err := fetchMessagePage(h.db, query, args, req)
+	if err != nil {
+		respondPageError(c, err)
+		return
 	}
 
 	c.JSON(http.StatusOK, ApiResponse{
 		Success: true,
-		Data:    messages,
+		Data:    cursorResponse(page.Messages, page.HasMore, req.Limit),
 	})
 }
 
+// respondCursorOnly answers a listing that never had page numbers. ?page=1 is
+// the newest page; any later page is refused rather than served as the first.
+func (h *MessageHandler) respondCursorOnly(c *gin.Context, query string, args []interface{}) {
+	req, err := parsePageRequest(c)
+	if err == errPageNumbered {
+		err = nil
+		if c.Query("page") != "1" {
+			err = ErrPageUnsupported
+		}
+	}
+	h.respondCursorPage(c, query, args, req, err)
+}
+
+// requireMember answers 404 unless userID currently belongs to the group
+func (h *MessageHandler) requireMember(c *gin.Context, groupID, userID int) bool {
+	_, err := groupRole(h.db, groupID, userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   ErrNotGroupMember.Error(),
+		})
+		return false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return false
+	}
+	return true
+}
+
 func (h *MessageHandler) MarkAsRead(c *gin.Context) {
 	userID, _, _ := GetUserFromContext(c)
 	messageIDsStr := c.Query("message_ids")
@@ -326,7 +407,7 @@ func (h *MessageHandler) MarkAsRead(c *gin.Context) {
 	}
 
 	messageIDStrs := strings.Split(messageIDsStr, ",")
-	messageIDs := make([]interface{}, len(messageIDStrs))
+	messageIDs := make([]int, len(messageIDStrs))
 
 	for i, idStr := range messageIDStrs {
 		id, err := strconv.Atoi(strings.TrimSpace(idStr))
@@ -340,14 +421,17 @@ func (h *MessageHandler) MarkAsRead(c *gin.Context) {
 		messageIDs[i] = id
 	}
 
-	placeholders := strings.Repeat("?,", len(messageIDs)-1) + "?"
-	query := `UPDATE message_recipients 
-			  SET is_read = true, read_at = NOW() 
-			  WHERE recipient_id = ? AND message_id IN (` + placeholders + `)`
-
-	args := append([]interface{}{userID}, messageIDs...)
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
 
-	_, err := h.db.Exec(query, args...)
+	receipts, err := messaging.MarkRead(tx, userID, messageIDs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ApiResponse{
 			Success: false,
@@ -356,8 +440,115 @@ func (h *MessageHandler) MarkAsRead(c *gin.Context) {
 		return
 	}
 
+	for senderID, readIDs := range receipts.BySender {
+		receipt := ReadReceipt{
+			ReaderID:   userID,
+			MessageIDs: readIDs,
+			ReadAt:     receipts.ReadAt,
+		}
+		if err := h.outbox.Enqueue(tx, MessageReadNotification(senderID, receipt)); err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to queue read receipts",
+			})
+			return
+		}
+	}
+
+	// The reader's unread count changed in the conversations the messages belong to
+	changed := map[int][]ConversationKey{userID: receipts.Conversations}
+	if err := enqueueConversationUpdates(tx, h.outbox, changed); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to queue conversation updates",
+		})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to mark messages as read",
+		})
+		return
+	}
+	h.outbox.Wake()
+
 	c.JSON(http.StatusOK, ApiResponse{
 		Success: true,
 		Message: "Messages marked as read",
 	})
 }
+
+func (h *MessageHandler) GetReadReceipts(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	messageID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid message ID",
+		})
+		return
+	}
+
+	var senderID int
+	err = h.db.QueryRow("SELECT sender_id FROM messages WHERE id = ?", messageID).Scan(&senderID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Message not found",
+		})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	// Only the sender may see who has read their message
+	if senderID != userID {
+		c.JSON(http.StatusForbidden, ApiResponse{
+			Success: false,
+			Error:   "Only the sender can view read receipts",
+		})
+		return
+	}
+
+	rows, err := h.db.Query(`
+		SELECT mr.id, mr.message_id, mr.recipient_id, mr.is_read, mr.delivered_at, mr.read_at, mr.created_at, u.username
+		FROM message_recipients mr
+		JOIN users u ON mr.recipient_id = u.id
+		WHERE mr.message_id = ?
+		ORDER BY mr.read_at IS NULL, mr.read_at, u.username
+	`, messageID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch read receipts",
+		})
+		return
+	}
+	defer rows.Close()
+
+	recipients := []MessageRecipient{}
+	for rows.Next() {
+		var recipient MessageRecipient
+		err := rows.Scan(
+			&recipient.ID, &recipient.MessageID, &recipient.RecipientID, &recipient.IsRead,
+			&recipient.DeliveredAt, &recipient.ReadAt, &recipient.CreatedAt, &recipient.RecipientUsername,
+		)
+		if err != nil {
+			continue
+		}
+		recipients = append(recipients, recipient)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    recipients,
+	})
+}
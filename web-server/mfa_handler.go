@@ -0,0 +1,478 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"chatapp/auth"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// PurposeMFA marks the challenge tokens Login returns when 2FA is enabled
+const PurposeMFA = "mfa"
+
+const recoveryCodeCount = 10
+
+var ErrInvalidMFACode = errors.New("Invalid authentication code")
+
+type MFAHandler struct {
+	db *sql.DB
+	// auth throttles code checks with the login throttle
+	auth *AuthHandler
+}
+
+func NewMFAHandler(db *sql.DB, auth *AuthHandler) *MFAHandler {
+	return &MFAHandler{db: db, auth: auth}
+}
+
+// Enroll generates a new TOTP secret. 2FA is not enabled until the secret is
+// confirmed with a code, so an abandoned enrollment has no effect.
+func (h *MFAHandler) Enroll(c *gin.Context) {
+	userID, _, email := GetUserFromContext(c)
+
+	var enabledAt sql.NullTime
+	if err := h.db.QueryRow("SELECT totp_enabled_at FROM users WHERE id = ?", userID).Scan(&enabledAt); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if enabledAt.Valid {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Two-factor authentication is already enabled",
+		})
+		return
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to generate secret",
+		})
+		return
+	}
+
+	if _, err := h.db.Exec(
+		"UPDATE users SET totp_secret = ?, totp_last_step = NULL WHERE id = ?",
+		secret, userID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start enrollment",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Scan the URI with an authenticator app, then confirm with a code",
+		Data: MFAEnrollResponse{
+			Secret:     secret,
+			OTPAuthURI: totpURI(getEnvOrDefault("MFA_ISSUER", "ChatApp"), email, secret),
+		},
+	})
+}
+
+// Confirm enables 2FA once the user proves their authenticator produces valid
+// codes, and returns the first set of recovery codes
+func (h *MFAHandler) Confirm(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	err := h.db.QueryRow("SELECT totp_secret, totp_enabled_at FROM users WHERE id = ?", userID).Scan(&secret, &enabledAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if enabledAt.Valid || !secret.Valid {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "No two-factor enrollment in progress",
+		})
+		return
+	}
+
+	step, ok := validateTOTP(secret.String, req.Code, time.Now())
+	if !ok {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   ErrInvalidMFACode.Error(),
+		})
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE users SET totp_enabled_at = NOW(), totp_last_step = ? WHERE id = ?",
+		step, userID,
+	); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		log.Printf("Failed to enable 2FA for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to enable two-factor authentication",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Two-factor authentication enabled. Store the recovery codes somewhere safe.",
+		Data:    RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// RegenerateRecoveryCodes replaces every recovery code, used or not
+func (h *MFAHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	userID, username, _ := GetUserFromContext(c)
+
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if !h.checkCode(c, userID, username, "", req.Code) {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	codes, err := replaceRecoveryCodes(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		log.Printf("Failed to regenerate recovery codes for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to generate recovery codes",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "New recovery codes generated, the old ones no longer work",
+		Data:    RecoveryCodesResponse{RecoveryCodes: codes},
+	})
+}
+
+// Disable turns 2FA off after checking the password and a current code or a
+// recovery code
+func (h *MFAHandler) Disable(c *gin.Context) {
+	userID, username, _ := GetUserFromContext(c)
+
+	var req DisableMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if !h.checkCode(c, userID, username, req.Password, req.Code) {
+		return
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to start transaction",
+		})
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		"UPDATE users SET totp_secret = NULL, totp_enabled_at = NULL, totp_last_step = NULL WHERE id = ?",
+		userID,
+	)
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID)
+	}
+	if err != nil || tx.Commit() != nil {
+		log.Printf("Failed to disable 2FA for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to disable two-factor authentication",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Two-factor authentication disabled",
+	})
+}
+
+// checkCode verifies a second factor for an enabled account, and the password
+// first unless it is empty, writing the error response itself when either
+// fails. Codes are only six digits, so like VerifyMFA every check counts
+// against the login throttle until it passes. A wrong code is a 400, not a
+// 401: the caller's access token is fine.
+func (h *MFAHandler) checkCode(c *gin.Context, userID int, username, password, code string) bool {
+	if h.auth.throttled(c, username) {
+		return false
+	}
+
+	// The password is checked before the code so a wrong one does not use up a
+	// recovery code
+	if password != "" {
+		var hashedPassword string
+		if err := h.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hashedPassword); err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Database error",
+			})
+			return false
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password)) != nil {
+			h.auth.loginFailed(c, AuditPasswordConfirmFailure, userID, username)
+			c.JSON(http.StatusBadRequest, ApiResponse{
+				Success: false,
+				Error:   "Password is incorrect",
+			})
+			return false
+		}
+	}
+
+	ok, err := verifySecondFactor(h.db, userID, code)
+	if err != nil {
+		log.Printf("Failed to verify 2FA code for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return false
+	}
+	if !ok {
+		h.auth.loginFailed(c, AuditMFAFailure, userID, username)
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   ErrInvalidMFACode.Error(),
+		})
+		return false
+	}
+	h.auth.attemptPassed(c, username)
+	return true
+}
+
+// VerifyMFA exchanges the challenge token from Login and a TOTP or recovery
+// code for a real token pair
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	claims, err := signingKeys.Parse(req.MFAToken)
+	if err != nil || claims.Purpose != PurposeMFA {
+		c.JSON(http.StatusUnauthorized, ApiResponse{
+			Success: false,
+			Error:   "Invalid or expired challenge, please log in again",
+		})
+		return
+	}
+
+	// Codes are only six digits, so guesses count against the same budget as passwords
+	if h.throttled(c, claims.Username) {
+		return
+	}
+
+	ok, err := verifySecondFactor(h.db, claims.UserID, req.Code)
+	if err != nil {
+		log.Printf("Failed to verify 2FA code for user %d: %v", claims.UserID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if !ok {
+		h.loginFailed(c, AuditMFAFailure, claims.UserID, claims.Username)
+		c.JSON(http.StatusUnauthorized, ApiResponse{
+			Success: false,
+			Error:   ErrInvalidMFACode.Error(),
+		})
+		return
+	}
+
+	var user User
+	err = h.db.QueryRow(
+		"SELECT id, username, email, email_verified_at, role, suspended_at, created_at, updated_at FROM users WHERE id = ?",
+		claims.UserID,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Role, &user.SuspendedAt, &user.CreatedAt, &user.UpdatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if h.suspended(c, user) {
+		return
+	}
+
+	h.loginSucceeded(c, user)
+
+	tokens, err := h.sessions.Create(user, c.Request.UserAgent(), c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to generate token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Login successful",
+		Data: AuthResponse{
+			Token:        tokens.AccessToken,
+			RefreshToken: tokens.RefreshToken,
+			ExpiresIn:    tokens.ExpiresIn,
+			User:         user,
+		},
+	})
+}
+
+// mfaChallengeToken is returned by Login in place of an access token when the
+// account has 2FA enabled
+func mfaChallengeToken(user User) (string, error) {
+	return signingKeys.Sign(&auth.Claims{
+		UserID:   user.ID,
+		Username: user.Username,
+		Purpose:  PurposeMFA,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(5 * time.Minute)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+		},
+	})
+}
+
+// verifySecondFactor accepts either a TOTP code or an unused recovery code for
+// an account with 2FA enabled. Each TOTP step and each recovery code is only
+// accepted once.
+func verifySecondFactor(db *sql.DB, userID int, code string) (bool, error) {
+	var secret sql.NullString
+	var enabledAt sql.NullTime
+	err := db.QueryRow("SELECT totp_secret, totp_enabled_at FROM users WHERE id = ?", userID).Scan(&secret, &enabledAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if !enabledAt.Valid || !secret.Valid {
+		return false, nil
+	}
+
+	if step, ok := validateTOTP(secret.String, code, time.Now()); ok {
+		result, err := db.Exec(
+			"UPDATE users SET totp_last_step = ? WHERE id = ? AND (totp_last_step IS NULL OR totp_last_step < ?)",
+			step, userID, step,
+		)
+		if err != nil {
+			return false, err
+		}
+		n, _ := result.RowsAffected()
+		return n == 1, nil
+	}
+
+	result, err := db.Exec(
+		"UPDATE mfa_recovery_codes SET used_at = NOW() WHERE user_id = ? AND code_hash = ? AND used_at IS NULL",
+		userID, hashToken(normalizeRecoveryCode(code)),
+	)
+	if err != nil {
+		return false, err
+	}
+	n, _ := result.RowsAffected()
+	return n == 1, nil
+}
+
+// replaceRecoveryCodes deletes the user's recovery codes and stores a fresh
+// set, returning the plain codes to show once
+func replaceRecoveryCodes(tx *sql.Tx, userID int) ([]string, error) {
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	encoding := base32.StdEncoding.WithPadding(base32.NoPadding)
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i++ {
+		raw, err := randomToken(5, encoding.EncodeToString)
+		if err != nil {
+			return nil, err
+		}
+		raw = strings.ToLower(raw)
+		code := raw[:4] + "-" + raw[4:]
+
+		if _, err := tx.Exec(
+			"INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES (?, ?)",
+			userID, hashToken(normalizeRecoveryCode(code)),
+		); err != nil {
+			return nil, err
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -1,25 +1,19 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"strings"
 	"time"
 
+	"chatapp/auth"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 )
 
-var jwtSecret = []byte("test secret chatapp")
-
-type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	Email    string `json:"email"`
-	jwt.RegisteredClaims
-}
-
-// validates JWT token
-func AuthMiddleware() gin.HandlerFunc {
+// validates JWT token and rejects tokens whose session was revoked. Personal
+// access tokens are accepted too, carrying only the scopes they were granted.
+func AuthMiddleware(sessions *Sessions, tokens *AccessTokens) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
@@ -41,11 +35,32 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-			return jwtSecret, nil
-		})
+		if strings.HasPrefix(tokenString, personalTokenPrefix) {
+			user, scopes, err := tokens.Authenticate(tokenString)
+			if err != nil {
+				status, message := http.StatusUnauthorized, "Invalid token"
+				if !errors.Is(err, ErrInvalidAccessToken) {
+					status, message = http.StatusInternalServerError, "Failed to verify token"
+				}
+				c.JSON(status, ApiResponse{
+					Success: false,
+					Error:   message,
+				})
+				c.Abort()
+				return
+			}
 
-		if err != nil || !token.Valid {
+			c.Set("user_id", user.ID)
+			c.Set("username", user.Username)
+			c.Set("email", user.Email)
+			c.Set("role", user.Role)
+			c.Set("scopes", scopes)
+			c.Next()
+			return
+		}
+
+		claims, err := signingKeys.Parse(tokenString)
+		if err != nil || !claims.IsAccessToken() {
 			c.JSON(http.StatusUnauthorized, ApiResponse{
 				Success: false,
 				Error:   "Invalid token",
@@ -54,11 +69,19 @@ func AuthMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		claims, ok := token.Claims.(*Claims)
-		if !ok {
+		active, err := sessions.Active(claims.SessionID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ApiResponse{
+				Success: false,
+				Error:   "Failed to verify session",
+			})
+			c.Abort()
+			return
+		}
+		if !active {
 			c.JSON(http.StatusUnauthorized, ApiResponse{
 				Success: false,
-				Error:   "Invalid token claims",
+				Error:   "Session revoked",
 			})
 			c.Abort()
 			return
@@ -67,23 +90,44 @@ func AuthMiddleware() gin.HandlerFunc {
 		c.Set("user_id", claims.UserID)
 		c.Set("username", claims.Username)
 		c.Set("email", claims.Email)
+		c.Set("role", claims.Role)
+		c.Set("session_id", claims.SessionID)
+		c.Set("scopes", sessionScopes)
 		c.Next()
 	}
 }
 
-func GenerateToken(user User) (string, error) {
-	claims := &Claims{
-		UserID:   user.ID,
-		Username: user.Username,
-		Email:    user.Email,
+// RequireRole restricts a route group to users holding at least role.
+// Must run after AuthMiddleware.
+func RequireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !auth.RoleAtLeast(GetRoleFromContext(c), role) {
+			c.JSON(http.StatusForbidden, ApiResponse{
+				Success: false,
+				Error:   "Requires the " + role + " role",
+			})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// GenerateToken signs an access token for user, bound to the session sessionID
+func GenerateToken(user User, sessionID string, ttl time.Duration) (string, error) {
+	claims := &auth.Claims{
+		UserID:    user.ID,
+		Username:  user.Username,
+		Email:     user.Email,
+		Role:      user.Role,
+		SessionID: sessionID,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().Add(24 * time.Hour)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signingKeys.Sign(claims)
 }
 
 func GetUserFromContext(c *gin.Context) (int, string, string) {
@@ -92,3 +136,13 @@ func GetUserFromContext(c *gin.Context) (int, string, string) {
 	email := c.GetString("email")
 	return userID, username, email
 }
+
+// GetRoleFromContext returns the role of the authenticated user
+func GetRoleFromContext(c *gin.Context) string {
+	return c.GetString("role")
+}
+
+// GetSessionIDFromContext returns the session the request's access token belongs to
+func GetSessionIDFromContext(c *gin.Context) string {
+	return c.GetString("session_id")
+}
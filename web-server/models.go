@@ -1,7 +1,10 @@
 package main
 
 import (
+	"encoding/json"
 	"time"
+
+	"chatapp/messaging"
 )
 
 type User struct {
@@ -11,33 +14,53 @@ type User struct {
 	Password  string    `json:"-"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
-}
 
-type Message struct {
-	ID          int       `json:"id"`
-	SenderID    int       `json:"sender_id"`
-	Content     string    `json:"content"`
-	MessageType string    `json:"message_type"` // ("direct", "broadcast")
-	MediaURL    *string   `json:"media_url"`
-	MediaType   *string   `json:"media_type"`
-	CreatedAt   time.Time `json:"created_at"`
-	
-	SenderUsername string              `json:"sender_username,omitempty"`
-	Recipients     []MessageRecipient  `json:"recipients,omitempty"`
+	// Nil until the user follows the link in their verification email
+	EmailVerifiedAt *time.Time `json:"email_verified_at"`
+
+	// Profile fields the user edits themselves; nil when unset
+	DisplayName *string `json:"display_name"`
+	Bio         *string `json:"bio"`
+	StatusText  *string `json:"status_text"`
+	Timezone    *string `json:"timezone"`
+	AvatarURL   *string `json:"avatar_url"`
+
+	// Role is "user", "moderator" or "admin". Suspended accounts cannot log in.
+	Role            string     `json:"role"`
+	SuspendedAt     *time.Time `json:"suspended_at,omitempty"`
+	SuspendedReason *string    `json:"suspended_reason,omitempty"`
+
+	// Bots are owned by a regular user and authenticate only with personal access tokens
+	IsBot   bool `json:"is_bot"`
+	OwnerID *int `json:"owner_id,omitempty"`
+
+	// Presence maintained by the WebSocket server ("online", "away", "offline")
+	Status     string     `json:"status,omitempty"`
+	LastSeenAt *time.Time `json:"last_seen_at,omitempty"`
 }
 
+// Message is the message format both servers share
+type Message = messaging.Message
+
 type MessageRecipient struct {
-	ID          int       `json:"id"`
-	MessageID   int       `json:"message_id"`
-	RecipientID int       `json:"recipient_id"`
-	IsRead      bool      `json:"is_read"`
+	ID          int        `json:"id"`
+	MessageID   int        `json:"message_id"`
+	RecipientID int        `json:"recipient_id"`
+	IsRead      bool       `json:"is_read"`
+	DeliveredAt *time.Time `json:"delivered_at"`
 	ReadAt      *time.Time `json:"read_at"`
-	CreatedAt   time.Time `json:"created_at"`
-	
+	CreatedAt   time.Time  `json:"created_at"`
+
 	// Additional fields for API responses
 	RecipientUsername string `json:"recipient_username,omitempty"`
 }
 
+type ReadReceipt struct {
+	ReaderID   int       `json:"reader_id"`
+	MessageIDs []int     `json:"message_ids"`
+	ReadAt     time.Time `json:"read_at"`
+}
+
 type RegisterRequest struct {
 	Username string `json:"username" binding:"required,min=3,max=50"`
 	Email    string `json:"email" binding:"required,email"`
@@ -49,30 +72,268 @@ type LoginRequest struct {
 	Password string `json:"password" binding:"required"`
 }
 
+type MFAChallengeResponse struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP code or recovery code
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// DisableMFARequest confirms turning 2FA off with the password as well as a code
+type DisableMFARequest struct {
+	Password string `json:"password" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type MFAEnrollResponse struct {
+	Secret     string `json:"secret"`
+	OTPAuthURI string `json:"otpauth_uri"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type VerifyEmailRequest struct {
+	Token string `json:"token" binding:"required"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token" binding:"required"`
+	Password string `json:"password" binding:"required,min=6"`
+}
+
+// UpdateProfileRequest changes only the fields that are present; an empty
+// string clears a field
+type UpdateProfileRequest struct {
+	DisplayName *string `json:"display_name" binding:"omitempty,max=100"`
+	Bio         *string `json:"bio" binding:"omitempty,max=500"`
+	StatusText  *string `json:"status_text" binding:"omitempty,max=140"`
+	Timezone    *string `json:"timezone" binding:"omitempty,max=64"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" binding:"required"`
+	NewPassword     string `json:"new_password" binding:"required,min=6"`
+}
+
+// AvatarResponse lists the generated square thumbnails by edge length in pixels
+type AvatarResponse struct {
+	AvatarURL  string            `json:"avatar_url"`
+	Thumbnails map[string]string `json:"thumbnails"`
+}
+
 type AuthResponse struct {
-	Token string `json:"token"`
-	User  User   `json:"user"`
+	Token        string `json:"token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	ExpiresIn    int    `json:"expires_in,omitempty"` // access token lifetime in seconds
+	User         User   `json:"user"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+// EditMessageRequest replaces the content of a message
+type EditMessageRequest struct {
+	Content string `json:"content" binding:"required"`
 }
 
-type SendMessageRequest struct {
-	Content     string   `json:"content" binding:"required"`
-	MessageType string   `json:"message_type" binding:"required,oneof=direct broadcast"`
-	Recipients  []int    `json:"recipients"` // For direct messages, will be empty for broadcast
-	MediaURL    *string  `json:"media_url"`
-	MediaType   *string  `json:"media_type"`
+// MessageRevision is the content a message had before one of its edits
+type MessageRevision struct {
+	ID               int       `json:"id"`
+	MessageID        int       `json:"message_id"`
+	Content          string    `json:"content"`
+	EditedBy         *int      `json:"edited_by"`
+	EditedByUsername *string   `json:"edited_by_username"`
+	CreatedAt        time.Time `json:"created_at"`
 }
 
+// MessageRevisionsResponse is a message with its prior versions, oldest first
+type MessageRevisionsResponse struct {
+	Message   Message           `json:"message"`
+	Revisions []MessageRevision `json:"revisions"`
+}
+
+// Group is a named conversation with a persistent member list
+type Group struct {
+	ID          int           `json:"id"`
+	Name        string        `json:"name"`
+	CreatedBy   *int          `json:"created_by"`
+	CreatedAt   time.Time     `json:"created_at"`
+	UpdatedAt   time.Time     `json:"updated_at"`
+	MemberCount int           `json:"member_count"`
+	Members     []GroupMember `json:"members,omitempty"`
+}
+
+type GroupMember struct {
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+	AvatarURL *string   `json:"avatar_url"`
+	Role      string    `json:"role"` // ("owner", "member")
+	JoinedAt  time.Time `json:"joined_at"`
+}
+
+type GroupListResponse struct {
+	Groups []Group `json:"groups"`
+}
+
+type CreateGroupRequest struct {
+	Name      string `json:"name" binding:"required,max=100"`
+	MemberIDs []int  `json:"member_ids"`
+}
+
+type RenameGroupRequest struct {
+	Name string `json:"name" binding:"required,max=100"`
+}
+
+type AddMembersRequest struct {
+	UserIDs []int `json:"user_ids" binding:"required,min=1"`
+}
+
+// Channel is a public topic channel. Joined, LastReadMessageID and
+// UnreadCount describe the requesting user's membership.
+type Channel struct {
+	ID                int       `json:"id"`
+	Name              string    `json:"name"`
+	Description       *string   `json:"description"`
+	CreatedBy         *int      `json:"created_by"`
+	CreatedAt         time.Time `json:"created_at"`
+	MemberCount       int       `json:"member_count"`
+	Joined            bool      `json:"joined"`
+	LastReadMessageID *int      `json:"last_read_message_id"`
+	UnreadCount       int       `json:"unread_count"`
+}
+
+type ChannelListResponse struct {
+	Channels []Channel `json:"channels"`
+}
+
+type CreateChannelRequest struct {
+	Name        string `json:"name" binding:"required,min=2,max=50"`
+	Description string `json:"description" binding:"max=255"`
+}
+
+// MarkChannelReadRequest moves the read pointer; without message_id it moves
+// to the channel's latest message
+type MarkChannelReadRequest struct {
+	MessageID *int `json:"message_id"`
+}
+
+// ConversationSummary is one entry of the conversation list, as seen by the
+// requesting user
+type ConversationSummary = messaging.ConversationSummary
+
+// ConversationListResponse is a page of conversations. NextCursor fetches
+// the next, less recently active page (?before=).
+type ConversationListResponse struct {
+	Conversations []ConversationSummary `json:"conversations"`
+	Limit         int                   `json:"limit"`
+	NextCursor    string                `json:"next_cursor,omitempty"`
+	HasMore       bool                  `json:"has_more"`
+}
+
+// MessageHistoryResponse is a page of messages. Total and Page are only set
+// for page-numbered requests; cursor requests skip the count. NextCursor
+// fetches older messages (?before=), PrevCursor newer ones (?after=).
 type MessageHistoryResponse struct {
-	Messages []Message `json:"messages"`
-	Total    int       `json:"total"`
-	Page     int       `json:"page"`
-	Limit    int       `json:"limit"`
+	Messages   []Message `json:"messages"`
+	Total      *int      `json:"total,omitempty"`
+	Page       int       `json:"page,omitempty"`
+	Limit      int       `json:"limit"`
+	NextCursor string    `json:"next_cursor,omitempty"`
+	PrevCursor string    `json:"prev_cursor,omitempty"`
+	HasMore    bool      `json:"has_more"`
 }
 
 type UserListResponse struct {
 	Users []User `json:"users"`
 }
 
+// PersonalAccessToken describes a token without its secret, which is only
+// returned once when the token is created
+type PersonalAccessToken struct {
+	ID         int        `json:"id"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+}
+
+type CreateTokenRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"min=0,max=3650"` // 0 means no expiry
+}
+
+type CreateTokenResponse struct {
+	Token       string              `json:"token"`
+	AccessToken PersonalAccessToken `json:"access_token"`
+}
+
+type TokenListResponse struct {
+	Tokens []PersonalAccessToken `json:"tokens"`
+}
+
+type CreateBotRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=50"`
+}
+
+// SessionInfo describes one logged-in device
+type SessionInfo struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IPAddress  string    `json:"ip_address"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"`
+}
+
+type SessionListResponse struct {
+	Sessions []SessionInfo `json:"sessions"`
+}
+
+type SuspendUserRequest struct {
+	Reason string `json:"reason" binding:"max=255"`
+}
+
+type UpdateRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+// BroadcastPolicy names the least privileged role allowed to send broadcast messages
+type BroadcastPolicy struct {
+	MinRole string `json:"min_role" binding:"required"`
+}
+
+type OutboxEntry struct {
+	ID            int64           `json:"id"`
+	EventType     string          `json:"event_type"`
+	Payload       json.RawMessage `json:"payload"`
+	Status        string          `json:"status"` // ("pending", "delivered", "dead")
+	Attempts      int             `json:"attempts"`
+	LastError     *string         `json:"last_error"`
+	NextAttemptAt time.Time       `json:"next_attempt_at"`
+	ParkedAt      *time.Time      `json:"parked_at"` // set once it no longer holds back later entries
+	CreatedAt     time.Time       `json:"created_at"`
+	DeliveredAt   *time.Time      `json:"delivered_at"`
+}
+
 type ApiResponse struct {
 	Success bool        `json:"success"`
 	Message string      `json:"message"`
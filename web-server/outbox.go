@@ -0,0 +1,274 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Outbox delivers WebSocket notifications that were written to the outbox table
+// in the same transaction as the change they describe. Entries are delivered in
+// id order and at least once: each carries its outbox id so the WebSocket server
+// can drop a redelivery. A failed entry holds back the ones after it and is
+// retried with exponential backoff until maxAttempts, after which it is
+// dead-lettered for inspection through the admin API. Entries the WebSocket
+// server rejects outright are dead-lettered at once.
+//
+// An entry the WebSocket server keeps failing on is parked after
+// blockingAttempts, so it cannot hold back everyone's notifications: it is
+// retried out of order from then on. An unreachable server parks nothing,
+// since the entries behind the head would fail the same way.
+type Outbox struct {
+	db          *sql.DB
+	wake        chan struct{}
+	batchSize   int
+	maxAttempts int
+	// blockingAttempts is how many failed attempts an entry may hold back the
+	// queue for before it is parked
+	blockingAttempts int
+	baseDelay        time.Duration
+	maxDelay         time.Duration
+	lease            time.Duration // how long a claimed entry is hidden from other dispatchers
+}
+
+func NewOutbox(db *sql.DB) *Outbox {
+	maxAttempts, err := strconv.Atoi(getEnvOrDefault("OUTBOX_MAX_ATTEMPTS", "10"))
+	if err != nil || maxAttempts < 1 {
+		maxAttempts = 10
+	}
+
+	blockingAttempts, err := strconv.Atoi(getEnvOrDefault("OUTBOX_MAX_BLOCKING_ATTEMPTS", "3"))
+	if err != nil || blockingAttempts < 1 {
+		blockingAttempts = 3
+	}
+
+	return &Outbox{
+		db:               db,
+		wake:             make(chan struct{}, 1),
+		batchSize:        50,
+		maxAttempts:      maxAttempts,
+		blockingAttempts: blockingAttempts,
+		baseDelay:        time.Second,
+		maxDelay:         5 * time.Minute,
+		lease:            30 * time.Second,
+	}
+}
+
+// Enqueue records a notification as part of tx; it is only dispatched if tx commits
+func (o *Outbox) Enqueue(tx *sql.Tx, notification WebSocketNotification) error {
+	payload, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox (event_type, payload) VALUES (?, ?)", notification.Type, payload)
+	return err
+}
+
+// Wake asks the dispatcher to look for new entries now instead of at the next poll
+func (o *Outbox) Wake() {
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Run dispatches pending entries forever
+func (o *Outbox) Run() {
+	poll := time.NewTicker(time.Second)
+	defer poll.Stop()
+	cleanup := time.NewTicker(time.Hour)
+	defer cleanup.Stop()
+
+	for {
+		select {
+		case <-o.wake:
+		case <-poll.C:
+		case <-cleanup.C:
+			o.purgeDelivered()
+			continue
+		}
+
+		for {
+			n, err := o.dispatchBatch()
+			if err != nil {
+				log.Printf("Outbox dispatch failed: %v", err)
+				break
+			}
+			if n < o.batchSize {
+				break
+			}
+		}
+	}
+}
+
+type outboxEntry struct {
+	id       int64
+	payload  []byte
+	attempts int
+}
+
+// dispatchBatch claims up to batchSize due entries and delivers them in order,
+// stopping at the first one that fails
+func (o *Outbox) dispatchBatch() (int, error) {
+	entries, err := o.claim()
+	if err != nil || len(entries) == 0 {
+		return 0, err
+	}
+
+	for i, entry := range entries {
+		payload, err := stampOutboxID(entry.payload, entry.id)
+		if err == nil {
+			err = sendWebSocketNotification(payload)
+		}
+		if err != nil {
+			o.markFailed(entry, err)
+			o.unclaim(entries[i+1:])
+			return i, nil
+		}
+		if _, err := o.db.Exec(
+			"UPDATE outbox SET status = 'delivered', delivered_at = NOW(), attempts = attempts + 1 WHERE id = ?",
+			entry.id,
+		); err != nil {
+			log.Printf("Failed to mark outbox entry %d delivered: %v", entry.id, err)
+		}
+	}
+
+	return len(entries), nil
+}
+
+// stampOutboxID adds the entry's id to its payload as outbox_id
+func stampOutboxID(payload []byte, id int64) ([]byte, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return nil, err
+	}
+	fields["outbox_id"] = json.RawMessage(strconv.FormatInt(id, 10))
+	return json.Marshal(fields)
+}
+
+// claim locks the oldest pending entries and pushes their next attempt past
+// the lease, so other web-server instances wait while they are delivered.
+// Only the run of due entries at the head is claimed: an entry waiting for
+// its retry holds back everything queued after it, unless it is parked.
+func (o *Outbox) claim() ([]outboxEntry, error) {
+	tx, err := o.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// No SKIP LOCKED: a second dispatcher waits here and then finds the head
+	// leased, rather than delivering later entries around it
+	rows, err := tx.Query(`
+		SELECT id, payload, attempts, next_attempt_at <= NOW() FROM outbox
+		WHERE status = 'pending' AND (parked_at IS NULL OR next_attempt_at <= NOW())
+		ORDER BY id
+		LIMIT ?
+		FOR UPDATE
+	`, o.batchSize)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []outboxEntry
+	var ids []interface{}
+	for rows.Next() {
+		var entry outboxEntry
+		var due bool
+		if err := rows.Scan(&entry.id, &entry.payload, &entry.attempts, &due); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if !due {
+			break
+		}
+		entries = append(entries, entry)
+		ids = append(ids, entry.id)
+	}
+	rows.Close()
+
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(ids)-1) + "?"
+	args := append([]interface{}{time.Now().Add(o.lease)}, ids...)
+	if _, err := tx.Exec("UPDATE outbox SET next_attempt_at = ? WHERE id IN ("+placeholders+")", args...); err != nil {
+		return nil, err
+	}
+
+	return entries, tx.Commit()
+}
+
+// unclaim makes claimed entries due again after an earlier entry failed, so
+// they are sent as soon as it is delivered or dead-lettered
+func (o *Outbox) unclaim(entries []outboxEntry) {
+	if len(entries) == 0 {
+		return
+	}
+	ids := make([]interface{}, len(entries))
+	for i, entry := range entries {
+		ids[i] = entry.id
+	}
+	placeholders := strings.Repeat("?,", len(ids)-1) + "?"
+	if _, err := o.db.Exec("UPDATE outbox SET next_attempt_at = NOW() WHERE id IN ("+placeholders+")", ids...); err != nil {
+		log.Printf("Failed to release claimed outbox entries: %v", err)
+	}
+}
+
+func (o *Outbox) markFailed(entry outboxEntry, cause error) {
+	attempts := entry.attempts + 1
+	if attempts >= o.maxAttempts || errors.Is(cause, ErrNotificationRejected) {
+		log.Printf("Outbox entry %d dead-lettered after %d attempts: %v", entry.id, attempts, cause)
+		_, err := o.db.Exec(
+			"UPDATE outbox SET status = 'dead', attempts = ?, last_error = ? WHERE id = ?",
+			attempts, cause.Error(), entry.id,
+		)
+		if err != nil {
+			log.Printf("Failed to dead-letter outbox entry %d: %v", entry.id, err)
+		}
+		return
+	}
+
+	query := "UPDATE outbox SET attempts = ?, last_error = ?, next_attempt_at = ? WHERE id = ?"
+	if o.parks(attempts, cause) {
+		query = "UPDATE outbox SET attempts = ?, last_error = ?, next_attempt_at = ?, parked_at = COALESCE(parked_at, NOW()) WHERE id = ?"
+	}
+	_, err := o.db.Exec(query, attempts, cause.Error(), time.Now().Add(o.backoff(attempts)), entry.id)
+	if err != nil {
+		log.Printf("Failed to reschedule outbox entry %d: %v", entry.id, err)
+	}
+}
+
+// parks reports whether an entry that failed with cause stops holding back
+// the queue. Only failures the WebSocket server answered count: if it cannot
+// be reached, every entry would fail, so order is kept.
+func (o *Outbox) parks(attempts int, cause error) bool {
+	return attempts >= o.blockingAttempts && errors.Is(cause, ErrNotificationFailed)
+}
+
+// backoff doubles the delay with every attempt, up to maxDelay
+func (o *Outbox) backoff(attempts int) time.Duration {
+	delay := o.baseDelay
+	for i := 1; i < attempts; i++ {
+		delay *= 2
+		if delay >= o.maxDelay {
+			return o.maxDelay
+		}
+	}
+	return delay
+}
+
+func (o *Outbox) purgeDelivered() {
+	_, err := o.db.Exec(
+		"DELETE FROM outbox WHERE status = 'delivered' AND delivered_at < ?",
+		time.Now().Add(-24*time.Hour),
+	)
+	if err != nil {
+		log.Printf("Failed to purge delivered outbox entries: %v", err)
+	}
+}
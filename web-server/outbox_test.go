@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestStampOutboxID(t *testing.T) {
+	payload, err := json.Marshal(NewMessageNotification(Message{ID: 7, Content: "hi"}, []int{2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stamped, err := stampOutboxID(payload, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var notification WebSocketNotification
+	if err := json.Unmarshal(stamped, &notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.OutboxID != 42 {
+		t.Errorf("outbox_id = %d, want 42", notification.OutboxID)
+	}
+	if notification.Type != "new_message" || notification.Message == nil || notification.Message.ID != 7 {
+		t.Errorf("payload changed: %s", stamped)
+	}
+	if len(notification.RecipientIDs) != 1 || notification.RecipientIDs[0] != 2 {
+		t.Errorf("recipient_ids = %v, want [2]", notification.RecipientIDs)
+	}
+}
+
+func TestOutboxParksOnlyEntriesTheServerFailsOn(t *testing.T) {
+	o := &Outbox{blockingAttempts: 3}
+	failed := fmt.Errorf("%w: status 500", ErrNotificationFailed)
+	unreachable := errors.New("failed to notify WebSocket server: connection refused")
+
+	tests := []struct {
+		attempts int
+		cause    error
+		want     bool
+	}{
+		{1, failed, false},
+		{3, failed, true},
+		{5, failed, true},
+		{5, unreachable, false},
+	}
+	for _, tt := range tests {
+		if got := o.parks(tt.attempts, tt.cause); got != tt.want {
+			t.Errorf("parks(%d, %v) = %v, want %v", tt.attempts, tt.cause, got, tt.want)
+		}
+	}
+}
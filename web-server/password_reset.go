@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidResetToken = errors.New("Invalid or expired reset token")
+
+// ForgotPassword emails a password reset link. It answers the same way whether
+// or not the address is registered, so it cannot be used to discover accounts.
+func (h *AuthHandler) ForgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	// Requests are limited per address and per IP, so the endpoint cannot be
+	// used to flood an inbox or to probe many addresses quickly
+	if h.resetThrottled(c, req.Email) {
+		return
+	}
+
+	var user User
+	err := h.db.QueryRow("SELECT id, username, email FROM users WHERE email = ?", req.Email).
+		Scan(&user.ID, &user.Username, &user.Email)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	if err == nil {
+		// The token is created and sent in the background so the response time
+		// does not reveal whether the account exists
+		go func() {
+			token, err := h.createResetToken(user.ID)
+			if err != nil {
+				log.Printf("Failed to create password reset token for user %d: %v", user.ID, err)
+				return
+			}
+			if err := h.mailer.Send(passwordResetMail(user, token)); err != nil {
+				log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+			}
+		}()
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "If that email is registered, a password reset link has been sent",
+	})
+}
+
+// ResetPassword sets a new password using a reset token and signs the user out everywhere
+func (h *AuthHandler) ResetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to hash password",
+		})
+		return
+	}
+
+	userID, err := h.consumeResetToken(req.Token, string(hashedPassword))
+	if errors.Is(err, ErrInvalidResetToken) {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+	if err != nil {
+		log.Printf("Failed to reset password: %v", err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to reset password",
+		})
+		return
+	}
+
+	// Whoever knew the old password must not stay signed in
+	if _, err := h.sessions.RevokeOthers(userID, "", RevokedPasswordReset); err != nil {
+		log.Printf("Failed to revoke sessions after password reset for user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Password has been reset, please log in",
+	})
+}
+
+// resetThrottled counts a reset request for the address from the client IP.
+// It answers 429 with Retry-After if either has asked too often recently.
+func (h *AuthHandler) resetThrottled(c *gin.Context, email string) bool {
+	wait, err := h.resets.Reserve(email, c.ClientIP())
+	if err != nil {
+		log.Printf("Reset throttle unavailable: %v", err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+
+	recordAuthEvent(h.db, c, AuditResetThrottled, 0, email)
+	c.Header("Retry-After", retryAfterSeconds(wait))
+	c.JSON(http.StatusTooManyRequests, ApiResponse{
+		Success: false,
+		Error:   "Too many password reset requests, try again later",
+	})
+	return true
+}
+
+// createResetToken stores a new reset token for the user, replacing any that are outstanding
+func (h *AuthHandler) createResetToken(userID int) (string, error) {
+	token, err := randomToken(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		"UPDATE password_resets SET used_at = NOW() WHERE user_id = ? AND used_at IS NULL",
+		userID,
+	); err != nil {
+		return "", err
+	}
+
+	ttl := parseDurationEnv("PASSWORD_RESET_TTL", time.Hour)
+	if _, err := tx.Exec(
+		"INSERT INTO password_resets (user_id, token_hash, expires_at) VALUES (?, ?, ?)",
+		userID, hashToken(token), time.Now().Add(ttl),
+	); err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+// consumeResetToken marks a reset token used and stores the new password hash,
+// returning the user the token belonged to
+func (h *AuthHandler) consumeResetToken(token, passwordHash string) (int, error) {
+	tx, err := h.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var userID int
+	err = tx.QueryRow(`
+		SELECT id, user_id FROM password_resets
+		WHERE token_hash = ? AND used_at IS NULL AND expires_at > NOW()
+		FOR UPDATE
+	`, hashToken(token)).Scan(&id, &userID)
+	if err == sql.ErrNoRows {
+		return 0, ErrInvalidResetToken
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE password_resets SET used_at = NOW() WHERE id = ?", id); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", passwordHash, userID); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+func passwordResetMail(user User, token string) Mail {
+	link := getEnvOrDefault("APP_BASE_URL", "http://localhost:3000") + "/?reset_token=" + url.QueryEscape(token)
+	return Mail{
+		To:      user.Email,
+		Subject: "Reset your ChatApp password",
+		Body: fmt.Sprintf(
+			"Hi %s,\n\nSomeone asked to reset the password for your account. If it was you, open this link:\n\n%s\n\n"+
+				"The link expires soon and can only be used once. If you did not ask for this, you can ignore this email.\n",
+			user.Username, link,
+		),
+	}
+}
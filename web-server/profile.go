@@ -0,0 +1,184 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var ErrInvalidTimezone = errors.New("Invalid timezone, use an IANA name such as Europe/Berlin")
+
+// loadProfile reads everything the user may see about their own account
+func loadProfile(db *sql.DB, userID int) (User, error) {
+	var user User
+	err := db.QueryRow(`
+		SELECT id, username, email, email_verified_at, role,
+		       display_name, bio, status_text, timezone, avatar_url, created_at, updated_at
+		FROM users WHERE id = ?
+	`, userID).Scan(
+		&user.ID, &user.Username, &user.Email, &user.EmailVerifiedAt, &user.Role,
+		&user.DisplayName, &user.Bio, &user.StatusText, &user.Timezone, &user.AvatarURL, &user.CreatedAt, &user.UpdatedAt,
+	)
+	return user, err
+}
+
+// UpdateProfile changes the display name, bio, status text and timezone.
+// Fields left out of the request are not touched.
+func (h *AuthHandler) UpdateProfile(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	var req UpdateProfileRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if req.Timezone != nil {
+		if tz := strings.TrimSpace(*req.Timezone); tz != "" {
+			// "Local" would mean the server's zone, which is meaningless to the client
+			if _, err := time.LoadLocation(tz); err != nil || tz == "Local" {
+				c.JSON(http.StatusBadRequest, ApiResponse{
+					Success: false,
+					Error:   ErrInvalidTimezone.Error(),
+				})
+				return
+			}
+		}
+	}
+
+	var sets []string
+	var args []interface{}
+	for _, field := range []struct {
+		column string
+		value  *string
+	}{
+		{"display_name", req.DisplayName},
+		{"bio", req.Bio},
+		{"status_text", req.StatusText},
+		{"timezone", req.Timezone},
+	} {
+		if field.value == nil {
+			continue
+		}
+		sets = append(sets, field.column+" = ?")
+		args = append(args, nullableString(*field.value))
+	}
+
+	if len(sets) == 0 {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "No profile fields to update",
+		})
+		return
+	}
+
+	args = append(args, userID)
+	if _, err := h.db.Exec("UPDATE users SET "+strings.Join(sets, ", ")+" WHERE id = ?", args...); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to update profile",
+		})
+		return
+	}
+
+	user, err := loadProfile(h.db, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to load profile",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Profile updated",
+		Data:    user,
+	})
+}
+
+// ChangePassword sets a new password after checking the current one, and
+// signs out every other session. Wrong passwords count against the login
+// throttle like failed logins do.
+func (h *AuthHandler) ChangePassword(c *gin.Context) {
+	userID, username, _ := GetUserFromContext(c)
+
+	var req ChangePasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if h.throttled(c, username) {
+		return
+	}
+
+	var hashedPassword string
+	if err := h.db.QueryRow("SELECT password_hash FROM users WHERE id = ?", userID).Scan(&hashedPassword); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+
+	// 400 rather than 401: the caller is authenticated, only the confirmation was wrong
+	if bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(req.CurrentPassword)) != nil {
+		h.loginFailed(c, AuditPasswordChangeFailure, userID, username)
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Current password is incorrect",
+		})
+		return
+	}
+
+	newHash, err := bcrypt.GenerateFromPassword([]byte(req.NewPassword), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to hash password",
+		})
+		return
+	}
+
+	if _, err := h.db.Exec("UPDATE users SET password_hash = ? WHERE id = ?", string(newHash), userID); err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to update password",
+		})
+		return
+	}
+	h.attemptPassed(c, username)
+	recordAuthEvent(h.db, c, AuditPasswordChanged, userID, username)
+
+	revoked, err := h.sessions.RevokeOthers(userID, GetSessionIDFromContext(c), RevokedPasswordChange)
+	if err != nil {
+		log.Printf("Failed to revoke sessions after password change for user %d: %v", userID, err)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Password changed",
+		Data:    map[string]int{"revoked": revoked},
+	})
+}
+
+// nullableString stores blank strings as NULL
+func nullableString(s string) interface{} {
+	if s = strings.TrimSpace(s); s == "" {
+		return nil
+	}
+	return s
+}
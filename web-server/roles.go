@@ -0,0 +1,20 @@
+package main
+
+import (
+	"errors"
+
+	"chatapp/auth"
+	"chatapp/messaging"
+)
+
+// Roles, as defined by the shared auth package
+const (
+	RoleUser      = auth.RoleUser
+	RoleModerator = auth.RoleModerator
+	RoleAdmin     = auth.RoleAdmin
+)
+
+var (
+	ErrAccountSuspended    = errors.New("Account suspended")
+	ErrBroadcastNotAllowed = messaging.ErrBroadcastNotAllowed
+)
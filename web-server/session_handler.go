@@ -0,0 +1,89 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+type SessionHandler struct {
+	sessions *Sessions
+}
+
+func NewSessionHandler(sessions *Sessions) *SessionHandler {
+	return &SessionHandler{sessions: sessions}
+}
+
+// ListSessions returns the caller's logged-in devices, flagging the one making the request
+func (h *SessionHandler) ListSessions(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+	currentID := GetSessionIDFromContext(c)
+
+	sessions, err := h.sessions.List(userID)
+	if err != nil {
+		log.Printf("Failed to list sessions for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch sessions",
+		})
+		return
+	}
+
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == currentID
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    SessionListResponse{Sessions: sessions},
+	})
+}
+
+// RevokeSession signs out a single device. Revoking the current session logs the caller out.
+func (h *SessionHandler) RevokeSession(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	revoked, err := h.sessions.Revoke(userID, c.Param("id"), RevokedByUser)
+	if err != nil {
+		log.Printf("Failed to revoke session for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to revoke session",
+		})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Session not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Session revoked",
+	})
+}
+
+// RevokeOtherSessions signs out every device except the one making the request
+func (h *SessionHandler) RevokeOtherSessions(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	count, err := h.sessions.RevokeOthers(userID, GetSessionIDFromContext(c), RevokedByUser)
+	if err != nil {
+		log.Printf("Failed to revoke sessions for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to revoke sessions",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Signed out of all other sessions",
+		Data:    map[string]int{"revoked": count},
+	})
+}
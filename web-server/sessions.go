@@ -0,0 +1,354 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"log"
+	"time"
+)
+
+// Session revocation reasons recorded in sessions.revoked_reason
+const (
+	RevokedLogout         = "logout"
+	RevokedTokenReuse     = "refresh_token_reuse"
+	RevokedByUser         = "signed_out"
+	RevokedPasswordReset  = "password_reset"
+	RevokedSuspended      = "account_suspended"
+	RevokedPasswordChange = "password_changed"
+	RevokedRoleChanged    = "role_changed"
+)
+
+var (
+	ErrInvalidRefreshToken = errors.New("Invalid or expired refresh token")
+	ErrRefreshTokenReused  = errors.New("Refresh token reuse detected, session revoked")
+)
+
+// TokenPair is what a client receives when it logs in or refreshes
+type TokenPair struct {
+	AccessToken  string
+	RefreshToken string
+	ExpiresIn    int // access token lifetime in seconds
+}
+
+// Sessions issues short-lived access tokens and rotating refresh tokens.
+//
+// Each refresh token is a row in the sessions table, stored as a SHA-256 hash.
+// Refreshing rotates it: the presented row is marked rotated and a new row is
+// inserted in the same family. The family ID is the session ID carried in
+// access tokens, so it stays stable for the lifetime of a login. Presenting a
+// rotated token again means it leaked, and the whole family is revoked.
+type Sessions struct {
+	db         *sql.DB
+	outbox     *Outbox
+	accessTTL  time.Duration
+	refreshTTL time.Duration
+}
+
+func NewSessions(db *sql.DB, outbox *Outbox) *Sessions {
+	return &Sessions{
+		db:         db,
+		outbox:     outbox,
+		accessTTL:  parseDurationEnv("ACCESS_TOKEN_TTL", 15*time.Minute),
+		refreshTTL: parseDurationEnv("REFRESH_TOKEN_TTL", 30*24*time.Hour),
+	}
+}
+
+// Create starts a new session family for user
+func (s *Sessions) Create(user User, userAgent, ipAddress string) (TokenPair, error) {
+	familyID, err := randomToken(16, hex.EncodeToString)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	refreshToken, err := s.insertRefreshToken(s.db, familyID, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return TokenPair{}, err
+	}
+
+	return s.issue(user, familyID, refreshToken)
+}
+
+// Refresh exchanges a refresh token for a new token pair, rotating it
+func (s *Sessions) Refresh(refreshToken, userAgent, ipAddress string) (TokenPair, User, error) {
+	var user User
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return TokenPair{}, user, err
+	}
+	defer tx.Rollback()
+
+	var id int64
+	var familyID string
+	var expiresAt time.Time
+	var rotatedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT s.id, s.family_id, s.expires_at, s.rotated_at, s.revoked_at,
+		       u.id, u.username, u.email, u.role, u.suspended_at, u.created_at, u.updated_at
+		FROM sessions s
+		JOIN users u ON s.user_id = u.id
+		WHERE s.refresh_token_hash = ?
+		FOR UPDATE
+	`, hashToken(refreshToken)).Scan(
+		&id, &familyID, &expiresAt, &rotatedAt, &revokedAt,
+		&user.ID, &user.Username, &user.Email, &user.Role, &user.SuspendedAt, &user.CreatedAt, &user.UpdatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+	if err != nil {
+		return TokenPair{}, user, err
+	}
+
+	if revokedAt.Valid || time.Now().After(expiresAt) || user.SuspendedAt != nil {
+		return TokenPair{}, user, ErrInvalidRefreshToken
+	}
+
+	if rotatedAt.Valid {
+		if _, err := s.revokeFamily(tx, user.ID, familyID, RevokedTokenReuse); err != nil {
+			return TokenPair{}, user, err
+		}
+		if err := tx.Commit(); err != nil {
+			return TokenPair{}, user, err
+		}
+		s.outbox.Wake()
+		log.Printf("Refresh token reuse for user %d, revoked session %s", user.ID, familyID)
+		return TokenPair{}, user, ErrRefreshTokenReused
+	}
+
+	if _, err := tx.Exec("UPDATE sessions SET rotated_at = NOW() WHERE id = ?", id); err != nil {
+		return TokenPair{}, user, err
+	}
+
+	next, err := s.insertRefreshToken(tx, familyID, user.ID, userAgent, ipAddress)
+	if err != nil {
+		return TokenPair{}, user, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return TokenPair{}, user, err
+	}
+
+	pair, err := s.issue(user, familyID, next)
+	return pair, user, err
+}
+
+// Active reports whether a session family can still be used. AuthMiddleware
+// calls it on every request so revocation takes effect immediately.
+func (s *Sessions) Active(familyID string) (bool, error) {
+	if familyID == "" {
+		return false, nil
+	}
+	var active bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM sessions
+			WHERE family_id = ? AND revoked_at IS NULL AND expires_at > NOW()
+		)
+	`, familyID).Scan(&active)
+	return active, err
+}
+
+// List returns the user's live sessions, most recently used first. A session
+// is last used when its refresh token was last rotated.
+func (s *Sessions) List(userID int) ([]SessionInfo, error) {
+	rows, err := s.db.Query(`
+		SELECT s.family_id, s.user_agent, s.ip_address, f.started_at, s.created_at, s.expires_at
+		FROM sessions s
+		JOIN (
+			SELECT family_id, MIN(created_at) AS started_at
+			FROM sessions
+			WHERE user_id = ?
+			GROUP BY family_id
+		) f ON f.family_id = s.family_id
+		WHERE s.user_id = ? AND s.rotated_at IS NULL AND s.revoked_at IS NULL AND s.expires_at > NOW()
+		ORDER BY s.created_at DESC
+	`, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := []SessionInfo{}
+	for rows.Next() {
+		var info SessionInfo
+		var userAgent, ipAddress sql.NullString
+		if err := rows.Scan(&info.ID, &userAgent, &ipAddress, &info.CreatedAt, &info.LastUsedAt, &info.ExpiresAt); err != nil {
+			return nil, err
+		}
+		info.UserAgent = userAgent.String
+		info.IPAddress = ipAddress.String
+		sessions = append(sessions, info)
+	}
+	return sessions, rows.Err()
+}
+
+// RevokeOthers ends every live session of the user except keepFamilyID and
+// returns how many were revoked
+func (s *Sessions) RevokeOthers(userID int, keepFamilyID, reason string) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		"SELECT DISTINCT family_id FROM sessions WHERE user_id = ? AND family_id != ? AND revoked_at IS NULL FOR UPDATE",
+		userID, keepFamilyID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var familyIDs []string
+	for rows.Next() {
+		var familyID string
+		if err := rows.Scan(&familyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		familyIDs = append(familyIDs, familyID)
+	}
+	rows.Close()
+
+	if len(familyIDs) == 0 {
+		return 0, nil
+	}
+
+	if _, err := tx.Exec(
+		"UPDATE sessions SET revoked_at = NOW(), revoked_reason = ? WHERE user_id = ? AND family_id != ? AND revoked_at IS NULL",
+		reason, userID, keepFamilyID,
+	); err != nil {
+		return 0, err
+	}
+	if err := s.outbox.Enqueue(tx, SessionRevokedNotification(userID, familyIDs)); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	s.outbox.Wake()
+	return len(familyIDs), nil
+}
+
+// RevokeByRefreshToken ends the session a refresh token belongs to. Unknown or
+// already revoked tokens are not an error, so logout is idempotent.
+func (s *Sessions) RevokeByRefreshToken(refreshToken, reason string) error {
+	var userID int
+	var familyID string
+	err := s.db.QueryRow(
+		"SELECT user_id, family_id FROM sessions WHERE refresh_token_hash = ?",
+		hashToken(refreshToken),
+	).Scan(&userID, &familyID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	_, err = s.Revoke(userID, familyID, reason)
+	return err
+}
+
+// Revoke ends one of the user's session families and disconnects its WebSocket
+// clients. It reports false if the user has no live session with that ID.
+func (s *Sessions) Revoke(userID int, familyID, reason string) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	revoked, err := s.revokeFamily(tx, userID, familyID, reason)
+	if err != nil || !revoked {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	s.outbox.Wake()
+	return true, nil
+}
+
+// revokeFamily marks every token of the family revoked and, if any were still
+// live, queues a session_revoked notification for the WebSocket server
+func (s *Sessions) revokeFamily(tx *sql.Tx, userID int, familyID, reason string) (bool, error) {
+	result, err := tx.Exec(
+		"UPDATE sessions SET revoked_at = NOW(), revoked_reason = ? WHERE family_id = ? AND user_id = ? AND revoked_at IS NULL",
+		reason, familyID, userID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return false, nil
+	}
+	return true, s.outbox.Enqueue(tx, SessionRevokedNotification(userID, []string{familyID}))
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+func (s *Sessions) insertRefreshToken(db execer, familyID string, userID int, userAgent, ipAddress string) (string, error) {
+	refreshToken, err := randomToken(32, base64.RawURLEncoding.EncodeToString)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO sessions (family_id, user_id, refresh_token_hash, user_agent, ip_address, expires_at)
+		 VALUES (?, ?, ?, ?, ?, ?)`,
+		familyID, userID, hashToken(refreshToken), truncate(userAgent, 255), ipAddress,
+		time.Now().Add(s.refreshTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	return refreshToken, nil
+}
+
+func (s *Sessions) issue(user User, familyID, refreshToken string) (TokenPair, error) {
+	accessToken, err := GenerateToken(user, familyID, s.accessTTL)
+	if err != nil {
+		return TokenPair{}, err
+	}
+	return TokenPair{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.accessTTL.Seconds()),
+	}, nil
+}
+
+func randomToken(size int, encode func([]byte) string) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return encode(b), nil
+}
+
+// hashToken is how refresh tokens are stored; they are random enough that a
+// plain SHA-256 is sufficient
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func truncate(s string, max int) string {
+	if len(s) > max {
+		return s[:max]
+	}
+	return s
+}
+
+func parseDurationEnv(key string, defaultValue time.Duration) time.Duration {
+	d, err := time.ParseDuration(getEnvOrDefault(key, ""))
+	if err != nil || d <= 0 {
+		return defaultValue
+	}
+	return d
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AttemptRecord is what the throttle remembers about one account or source IP
+type AttemptRecord struct {
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// AttemptStore holds attempt records. MemoryAttemptStore suits a single
+// web-server; running several behind a load balancer needs a shared store
+// (Redis, the database) implementing the same interface.
+type AttemptStore interface {
+	Get(key string) (AttemptRecord, error)
+	// Update applies fn to the record for key atomically and returns the result
+	Update(key string, fn func(*AttemptRecord)) (AttemptRecord, error)
+	Delete(key string) error
+}
+
+// LoginThrottle slows down password guessing. Every attempt is counted against
+// both the account and the source IP before the credentials are checked, so
+// parallel guesses cannot all slip through before the first failure is
+// recorded. After a few attempts each further one has to wait progressively
+// longer, and once a limit is reached the key is locked out entirely for a
+// while. Attempts that turn out to be right are given back. Successful logins
+// clear the account's failures but not the IP's, so one valid account cannot
+// be used to reset an attacker's budget.
+type LoginThrottle struct {
+	store  AttemptStore
+	now    func() time.Time
+	prefix string // namespace of the throttle's keys in a shared store
+
+	accountLimit int           // failures per account before lockout
+	ipLimit      int           // failures per IP before lockout
+	freeAttempts int           // failures allowed before delays start
+	baseDelay    time.Duration // first progressive delay, doubled per failure
+	maxDelay     time.Duration
+	window       time.Duration // failures older than this are forgotten
+	lockout      time.Duration
+}
+
+func NewLoginThrottle(store AttemptStore) *LoginThrottle {
+	return &LoginThrottle{
+		store:        store,
+		now:          time.Now,
+		accountLimit: parseIntEnv("LOGIN_MAX_ACCOUNT_FAILURES", 5),
+		ipLimit:      parseIntEnv("LOGIN_MAX_IP_FAILURES", 20),
+		freeAttempts: 2,
+		baseDelay:    time.Second,
+		maxDelay:     30 * time.Second,
+		window:       parseDurationEnv("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		lockout:      parseDurationEnv("LOGIN_LOCKOUT", 15*time.Minute),
+	}
+}
+
+// NewResetThrottle limits password reset requests per address and per IP. It
+// reuses the login throttle's counting under its own keys and limits, and
+// requests are never given back, so it never touches the login budget.
+func NewResetThrottle(store AttemptStore) *LoginThrottle {
+	return &LoginThrottle{
+		store:        store,
+		now:          time.Now,
+		prefix:       "reset:",
+		accountLimit: parseIntEnv("RESET_MAX_ADDRESS_REQUESTS", 5),
+		ipLimit:      parseIntEnv("RESET_MAX_IP_REQUESTS", 20),
+		freeAttempts: 2,
+		baseDelay:    time.Second,
+		maxDelay:     30 * time.Second,
+		window:       parseDurationEnv("RESET_REQUEST_WINDOW", time.Hour),
+		lockout:      parseDurationEnv("RESET_LOCKOUT", time.Hour),
+	}
+}
+
+// Reserve counts an attempt for account from ip as a failure until it is
+// given back. If either key is still waiting it returns how long, and nothing
+// is counted.
+func (t *LoginThrottle) Reserve(account, ip string) (time.Duration, error) {
+	now := t.now()
+	var wait time.Duration
+	var reserved []int
+
+	keys := t.keys(account, ip)
+	for i, key := range keys {
+		limit := t.limits()[i]
+		var blocked time.Duration
+		_, err := t.store.Update(key, func(r *AttemptRecord) {
+			if d := r.LockedUntil.Sub(now); d > 0 {
+				blocked = d
+				return
+			}
+			if now.Sub(r.LastFailure) > t.window {
+				r.Failures = 0
+			}
+			r.Failures++
+			r.LastFailure = now
+			r.LockedUntil = now.Add(t.penalty(r.Failures, limit))
+		})
+		if err != nil {
+			t.release(keys, reserved)
+			return 0, err
+		}
+		if blocked > 0 {
+			if blocked > wait {
+				wait = blocked
+			}
+			continue
+		}
+		reserved = append(reserved, i)
+	}
+
+	if wait > 0 {
+		t.release(keys, reserved)
+	}
+	return wait, nil
+}
+
+// Release gives back a reserved attempt that did not fail, e.g. a right
+// password that still needs a second factor
+func (t *LoginThrottle) Release(account, ip string) error {
+	return t.release(t.keys(account, ip), []int{0, 1})
+}
+
+// Success clears the account's failures after a successful login and gives
+// back the IP's reserved attempt
+func (t *LoginThrottle) Success(account, ip string) error {
+	if err := t.store.Delete(t.keys(account, ip)[0]); err != nil {
+		return err
+	}
+	return t.release(t.keys(account, ip), []int{1})
+}
+
+// release takes one attempt off each of the given keys and shortens their
+// wait to match
+func (t *LoginThrottle) release(keys []string, which []int) error {
+	for _, i := range which {
+		limit := t.limits()[i]
+		_, err := t.store.Update(keys[i], func(r *AttemptRecord) {
+			if r.Failures == 0 {
+				return
+			}
+			r.Failures--
+			r.LockedUntil = r.LastFailure.Add(t.penalty(r.Failures, limit))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// penalty is how long a key must wait after its nth failure
+func (t *LoginThrottle) penalty(failures, limit int) time.Duration {
+	if failures >= limit {
+		return t.lockout
+	}
+	if failures <= t.freeAttempts {
+		return 0
+	}
+	delay := t.baseDelay
+	for i := t.freeAttempts + 1; i < failures; i++ {
+		delay *= 2
+		if delay >= t.maxDelay {
+			return t.maxDelay
+		}
+	}
+	return delay
+}
+
+func (t *LoginThrottle) keys(account, ip string) []string {
+	return []string{t.prefix + accountKey(account), t.prefix + "ip:" + ip}
+}
+
+// limits are the lockout limits of the keys returned by keys, in order
+func (t *LoginThrottle) limits() []int {
+	return []int{t.accountLimit, t.ipLimit}
+}
+
+func accountKey(account string) string {
+	return "account:" + strings.ToLower(account)
+}
+
+// retryAfterSeconds rounds a wait up to whole seconds for the Retry-After header
+func retryAfterSeconds(wait time.Duration) string {
+	seconds := int((wait + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return strconv.Itoa(seconds)
+}
+
+// MemoryAttemptStore keeps attempt records in process memory
+type MemoryAttemptStore struct {
+	mu      sync.Mutex
+	records map[string]AttemptRecord
+	ttl     time.Duration // records idle for longer than this are pruned
+	updates int
+}
+
+func NewMemoryAttemptStore(ttl time.Duration) *MemoryAttemptStore {
+	return &MemoryAttemptStore{records: make(map[string]AttemptRecord), ttl: ttl}
+}
+
+func (s *MemoryAttemptStore) Get(key string) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.records[key], nil
+}
+
+func (s *MemoryAttemptStore) Update(key string, fn func(*AttemptRecord)) (AttemptRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record := s.records[key]
+	fn(&record)
+	s.records[key] = record
+
+	s.updates++
+	if s.updates%1024 == 0 {
+		s.prune(time.Now())
+	}
+	return record, nil
+}
+
+func (s *MemoryAttemptStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, key)
+	return nil
+}
+
+func (s *MemoryAttemptStore) prune(now time.Time) {
+	for key, record := range s.records {
+		if now.After(record.LockedUntil) && now.Sub(record.LastFailure) > s.ttl {
+			delete(s.records, key)
+		}
+	}
+}
+
+func parseIntEnv(key string, defaultValue int) int {
+	n, err := strconv.Atoi(getEnvOrDefault(key, ""))
+	if err != nil || n < 1 {
+		return defaultValue
+	}
+	return n
+}
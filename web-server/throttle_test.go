@@ -0,0 +1,153 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+func newTestThrottle() (*LoginThrottle, *fakeClock) {
+	clock := &fakeClock{t: time.Unix(1700000000, 0)}
+	throttle := NewLoginThrottle(NewMemoryAttemptStore(time.Hour))
+	throttle.now = clock.now
+	throttle.accountLimit = 5
+	throttle.ipLimit = 8
+	throttle.window = 15 * time.Minute
+	throttle.lockout = 15 * time.Minute
+	return throttle, clock
+}
+
+func TestLoginThrottleProgressiveDelayThenLockout(t *testing.T) {
+	throttle, clock := newTestThrottle()
+
+	want := []time.Duration{0, 0, time.Second, 2 * time.Second, 15 * time.Minute}
+	for i, expected := range want {
+		wait, err := throttle.Reserve("jane", "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait != 0 {
+			t.Fatalf("attempt %d: blocked for %v before it was made", i+1, wait)
+		}
+		// The reserved attempt holds back the next one until it has waited
+		record, _ := throttle.store.Get(accountKey("jane"))
+		if wait := record.LockedUntil.Sub(clock.now()); wait != expected {
+			t.Fatalf("after attempt %d: wait %v, want %v", i+1, wait, expected)
+		}
+		clock.advance(expected)
+	}
+
+	clock.advance(-time.Minute)
+	if wait, _ := throttle.Reserve("JANE", "10.0.0.2"); wait != time.Minute {
+		t.Errorf("account lockout should apply from any IP and any case, got wait %v", wait)
+	}
+}
+
+func TestLoginThrottleParallelAttemptsAreCounted(t *testing.T) {
+	throttle, _ := newTestThrottle()
+
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if wait, err := throttle.Reserve("jane", "10.0.0.1"); err == nil && wait == 0 {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Two free attempts, then the third one starts the delay
+	if allowed != 3 {
+		t.Errorf("expected 3 parallel attempts to get through, got %d", allowed)
+	}
+}
+
+func TestLoginThrottleSuccessClearsAccountButNotIP(t *testing.T) {
+	throttle, clock := newTestThrottle()
+
+	for i := 0; i < 7; i++ {
+		throttle.Reserve("user"+string(rune('a'+i)), "10.0.0.1")
+		clock.advance(time.Minute)
+	}
+	throttle.Reserve("usera", "10.0.0.1")
+	if err := throttle.Success("usera", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The successful attempt was given back, so mallory's is the IP's 8th failure
+	clock.advance(time.Minute)
+	throttle.Reserve("mallory", "10.0.0.1")
+	if wait, _ := throttle.Reserve("eve", "10.0.0.1"); wait != 15*time.Minute {
+		t.Errorf("IP should be locked out after its 8th failure, got wait %v", wait)
+	}
+	if wait, _ := throttle.Reserve("usera", "10.0.0.9"); wait != 0 {
+		t.Errorf("account should be clear after a successful login, got wait %v", wait)
+	}
+}
+
+func TestLoginThrottleReleaseGivesBackTheAttempt(t *testing.T) {
+	throttle, _ := newTestThrottle()
+
+	for i := 0; i < 3; i++ {
+		throttle.Reserve("jane", "10.0.0.1")
+	}
+	if err := throttle.Release("jane", "10.0.0.1"); err != nil {
+		t.Fatal(err)
+	}
+	if wait, _ := throttle.Reserve("jane", "10.0.0.1"); wait != 0 {
+		t.Errorf("a released attempt should not delay the next one, got wait %v", wait)
+	}
+}
+
+func TestLoginThrottleForgetsOldFailures(t *testing.T) {
+	throttle, clock := newTestThrottle()
+
+	for i := 0; i < 4; i++ {
+		throttle.Reserve("jane", "10.0.0.1")
+		clock.advance(time.Minute)
+	}
+	clock.advance(20 * time.Minute)
+
+	throttle.Reserve("jane", "10.0.0.1")
+	if wait, _ := throttle.Reserve("jane", "10.0.0.1"); wait != 0 {
+		t.Errorf("failures outside the window should not count, got wait %v", wait)
+	}
+}
+
+func TestResetThrottleKeepsToItsOwnKeys(t *testing.T) {
+	store := NewMemoryAttemptStore(time.Hour)
+	login := NewLoginThrottle(store)
+	resets := NewResetThrottle(store)
+
+	for i := 0; i < 10; i++ {
+		resets.Reserve("jane@example.com", "10.0.0.1")
+	}
+	if wait, _ := resets.Reserve("jane@example.com", "10.0.0.1"); wait == 0 {
+		t.Error("repeated reset requests should be throttled")
+	}
+	if wait, _ := login.Reserve("jane@example.com", "10.0.0.1"); wait != 0 {
+		t.Errorf("reset requests should not count against logins, got wait %v", wait)
+	}
+}
+
+func TestRetryAfterSecondsRoundsUp(t *testing.T) {
+	tests := map[time.Duration]string{
+		0:                       "1",
+		1500 * time.Millisecond: "2",
+		15 * time.Minute:        "900",
+	}
+	for wait, want := range tests {
+		if got := retryAfterSeconds(wait); got != want {
+			t.Errorf("retryAfterSeconds(%v) = %s, want %s", wait, got, want)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// botEmailDomain gives bot accounts a unique placeholder address; .invalid is
+// reserved and can never receive mail
+const botEmailDomain = "bots.invalid"
+
+type TokenHandler struct {
+	db     *sql.DB
+	tokens *AccessTokens
+}
+
+func NewTokenHandler(db *sql.DB, tokens *AccessTokens) *TokenHandler {
+	return &TokenHandler{db: db, tokens: tokens}
+}
+
+// ListTokens returns the caller's personal access tokens
+func (h *TokenHandler) ListTokens(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+	h.listTokens(c, userID)
+}
+
+// CreateToken mints a personal access token for the caller
+func (h *TokenHandler) CreateToken(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+	h.createToken(c, userID)
+}
+
+// RevokeToken revokes one of the caller's tokens or one of their bots' tokens
+func (h *TokenHandler) RevokeToken(c *gin.Context) {
+	userID, _, _ := GetUserFromContext(c)
+
+	tokenID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid token ID",
+		})
+		return
+	}
+
+	revoked, err := h.tokens.Revoke(userID, tokenID)
+	if err != nil {
+		log.Printf("Failed to revoke access token %d: %v", tokenID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to revoke token",
+		})
+		return
+	}
+	if !revoked {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Token not found",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Message: "Token revoked",
+	})
+}
+
+// CreateBot creates a bot account owned by the caller. Bots have no password
+// and can only authenticate with personal access tokens minted by their owner.
+func (h *TokenHandler) CreateBot(c *gin.Context) {
+	ownerID, _, _ := GetUserFromContext(c)
+
+	var req CreateBotRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	email := req.Username + "@" + botEmailDomain
+
+	var exists bool
+	err := h.db.QueryRow("SELECT EXISTS(SELECT 1 FROM users WHERE username = ? OR email = ?)", req.Username, email).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return
+	}
+	if exists {
+		c.JSON(http.StatusConflict, ApiResponse{
+			Success: false,
+			Error:   "Username already exists",
+		})
+		return
+	}
+
+	// "!" is never a valid bcrypt hash, so password login always fails. The bot
+	// inherits its owner's email verification.
+	result, err := h.db.Exec(`
+		INSERT INTO users (username, email, password_hash, is_bot, owner_id, email_verified_at)
+		SELECT ?, ?, '!', TRUE, id, email_verified_at FROM users WHERE id = ?
+	`, req.Username, email, ownerID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create bot",
+		})
+		return
+	}
+
+	botID, _ := result.LastInsertId()
+	bot, err := h.loadBot(ownerID, int(botID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to load bot",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Message: "Bot created, mint a token for it at /api/bots/:id/tokens",
+		Data:    bot,
+	})
+}
+
+// ListBots returns the bots owned by the caller
+func (h *TokenHandler) ListBots(c *gin.Context) {
+	ownerID, _, _ := GetUserFromContext(c)
+
+	rows, err := h.db.Query(
+		"SELECT id, username, email, is_bot, owner_id, created_at, updated_at FROM users WHERE owner_id = ? ORDER BY username",
+		ownerID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch bots",
+		})
+		return
+	}
+	defer rows.Close()
+
+	bots := []User{}
+	for rows.Next() {
+		var bot User
+		if err := rows.Scan(&bot.ID, &bot.Username, &bot.Email, &bot.IsBot, &bot.OwnerID, &bot.CreatedAt, &bot.UpdatedAt); err != nil {
+			continue
+		}
+		bots = append(bots, bot)
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    UserListResponse{Users: bots},
+	})
+}
+
+// ListBotTokens returns the tokens of one of the caller's bots
+func (h *TokenHandler) ListBotTokens(c *gin.Context) {
+	if bot, ok := h.ownedBot(c); ok {
+		h.listTokens(c, bot.ID)
+	}
+}
+
+// CreateBotToken mints a token for one of the caller's bots
+func (h *TokenHandler) CreateBotToken(c *gin.Context) {
+	if bot, ok := h.ownedBot(c); ok {
+		h.createToken(c, bot.ID)
+	}
+}
+
+func (h *TokenHandler) listTokens(c *gin.Context, userID int) {
+	tokens, err := h.tokens.List(userID)
+	if err != nil {
+		log.Printf("Failed to list access tokens for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to fetch tokens",
+		})
+		return
+	}
+
+	c.JSON(http.StatusOK, ApiResponse{
+		Success: true,
+		Data:    TokenListResponse{Tokens: tokens},
+	})
+}
+
+func (h *TokenHandler) createToken(c *gin.Context, userID int) {
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	if err := validateScopes(req.Scopes); err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   err.Error(),
+		})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.ExpiresInDays > 0 {
+		t := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		expiresAt = &t
+	}
+
+	pat, token, err := h.tokens.Create(userID, req.Name, req.Scopes, expiresAt)
+	if err != nil {
+		log.Printf("Failed to create access token for user %d: %v", userID, err)
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Failed to create token",
+		})
+		return
+	}
+
+	c.JSON(http.StatusCreated, ApiResponse{
+		Success: true,
+		Message: "Token created. Copy it now, it will not be shown again.",
+		Data: CreateTokenResponse{
+			Token:       token,
+			AccessToken: pat,
+		},
+	})
+}
+
+// ownedBot loads the bot named by the :id parameter, answering 404 unless the caller owns it
+func (h *TokenHandler) ownedBot(c *gin.Context) (User, bool) {
+	ownerID, _, _ := GetUserFromContext(c)
+
+	botID, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ApiResponse{
+			Success: false,
+			Error:   "Invalid bot ID",
+		})
+		return User{}, false
+	}
+
+	bot, err := h.loadBot(ownerID, botID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, ApiResponse{
+			Success: false,
+			Error:   "Bot not found",
+		})
+		return User{}, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ApiResponse{
+			Success: false,
+			Error:   "Database error",
+		})
+		return User{}, false
+	}
+	return bot, true
+}
+
+func (h *TokenHandler) loadBot(ownerID, botID int) (User, error) {
+	var bot User
+	err := h.db.QueryRow(
+		"SELECT id, username, email, is_bot, owner_id, created_at, updated_at FROM users WHERE id = ? AND owner_id = ? AND is_bot = TRUE",
+		botID, ownerID,
+	).Scan(&bot.ID, &bot.Username, &bot.Email, &bot.IsBot, &bot.OwnerID, &bot.CreatedAt, &bot.UpdatedAt)
+	return bot, err
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors for SHA-1, truncated to 6 digits
+func TestTOTPCodeMatchesRFC6238(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	vectors := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, v := range vectors {
+		got, err := totpCode(secret, v.unix/totpPeriod)
+		if err != nil {
+			t.Fatalf("totpCode(%d): %v", v.unix, err)
+		}
+		if got != v.code {
+			t.Errorf("totpCode at %d = %s, want %s", v.unix, got, v.code)
+		}
+	}
+}
+
+func TestValidateTOTPAllowsOneStepOfDrift(t *testing.T) {
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	current := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name  string
+		step  int64
+		valid bool
+	}{
+		{"current step", current, true},
+		{"previous step", current - 1, true},
+		{"next step", current + 1, true},
+		{"two steps behind", current - 2, false},
+		{"two steps ahead", current + 2, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, _ := totpCode(secret, tt.step)
+			step, ok := validateTOTP(secret, code, now)
+			if ok != tt.valid {
+				t.Fatalf("validateTOTP = %v, want %v", ok, tt.valid)
+			}
+			if ok && step != tt.step {
+				t.Errorf("matched step %d, want %d", step, tt.step)
+			}
+		})
+	}
+
+	if _, ok := validateTOTP(secret, "12345", now); ok {
+		t.Error("accepted a code of the wrong length")
+	}
+}
+
+func TestTOTPURI(t *testing.T) {
+	uri := totpURI("ChatApp", "jane@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/ChatApp:jane@example.com?") {
+		t.Errorf("unexpected label in %s", uri)
+	}
+	for _, part := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=ChatApp", "digits=6", "period=30"} {
+		if !strings.Contains(uri, part) {
+			t.Errorf("%s missing %s", uri, part)
+		}
+	}
+}
@@ -2,42 +2,151 @@ package main
 
 import (
 	"bytes"
-	"encoding/json"
-	"log"
+	"errors"
+	"fmt"
 	"net/http"
+	"time"
+
+	"chatapp/auth"
 )
 
 type WebSocketNotification struct {
-	Type        string `json:"type"`
-	Message     Message `json:"message"`
-	RecipientIDs []int  `json:"recipient_ids"`
+	Type         string       `json:"type"`
+	OutboxID     int64        `json:"outbox_id,omitempty"` // set by the outbox when the entry is sent
+	Message      *Message     `json:"message,omitempty"`
+	Receipt      *ReadReceipt `json:"receipt,omitempty"`
+	MessageID    int          `json:"message_id,omitempty"`
+	Group        *Group       `json:"group,omitempty"`
+	ChannelID    int          `json:"channel_id,omitempty"`
+	SessionIDs   []string     `json:"session_ids,omitempty"`
+	RecipientIDs []int        `json:"recipient_ids"`
+	// Conversations lists, per user, the conversations whose last message or
+	// unread count changed
+	Conversations map[int][]ConversationKey `json:"conversations,omitempty"`
 }
 
-// NotifyWebSocketServer sends a notification to the WebSocket server about a new message
-func NotifyWebSocketServer(message Message, recipientIDs []int) {
-	wsServerURL := getEnvOrDefault("WEBSOCKET_SERVER_URL", "http://websocket-server:8081")
-	
-	notification := WebSocketNotification{
+// NewMessageNotification tells the WebSocket server about a new message
+func NewMessageNotification(message Message, recipientIDs []int) WebSocketNotification {
+	return WebSocketNotification{
 		Type:         "new_message",
-		Message:      message,
+		Message:      &message,
 		RecipientIDs: recipientIDs,
 	}
-	
-	jsonData, err := json.Marshal(notification)
+}
+
+// MessageReadNotification asks the WebSocket server to push a read receipt to
+// the message sender and the reader's devices
+func MessageReadNotification(senderID int, receipt ReadReceipt) WebSocketNotification {
+	return WebSocketNotification{
+		Type:         "message_read",
+		Receipt:      &receipt,
+		RecipientIDs: []int{senderID},
+	}
+}
+
+// MessageDeletedNotification tells the sender and recipients of a message, or
+// the subscribers of its channel, that a moderator removed it
+func MessageDeletedNotification(message Message, userIDs []int) WebSocketNotification {
+	notification := WebSocketNotification{
+		Type:         "message_deleted",
+		MessageID:    message.ID,
+		RecipientIDs: userIDs,
+	}
+	if message.ChannelID != nil {
+		notification.ChannelID = *message.ChannelID
+	}
+	return notification
+}
+
+// MessageEditedNotification pushes the new version of an edited message to
+// its sender and recipients, or to the channel's subscribers
+func MessageEditedNotification(message Message, userIDs []int) WebSocketNotification {
+	return WebSocketNotification{
+		Type:         "message_edited",
+		Message:      &message,
+		RecipientIDs: userIDs,
+	}
+}
+
+// GroupUpdatedNotification tells current and former members that a group
+// was created, renamed, or its membership changed
+func GroupUpdatedNotification(group Group, userIDs []int) WebSocketNotification {
+	return WebSocketNotification{
+		Type:         "group_updated",
+		Group:        &group,
+		RecipientIDs: userIDs,
+	}
+}
+
+// ConversationsChangedNotification asks the WebSocket server to send each
+// user their new view of the conversations whose last message or unread
+// count changed. The views are loaded there, after the change commits.
+func ConversationsChangedNotification(keys map[int][]ConversationKey) WebSocketNotification {
+	return WebSocketNotification{
+		Type:          "conversations_changed",
+		Conversations: keys,
+	}
+}
+
+// ChannelLeftNotification asks the WebSocket server to drop the user's
+// subscriptions to a channel they left
+func ChannelLeftNotification(channelID, userID int) WebSocketNotification {
+	return WebSocketNotification{
+		Type:         "channel_left",
+		ChannelID:    channelID,
+		RecipientIDs: []int{userID},
+	}
+}
+
+// SessionRevokedNotification asks the WebSocket server to disconnect the
+// user's sockets that were opened with one of the revoked sessions
+func SessionRevokedNotification(userID int, sessionIDs []string) WebSocketNotification {
+	return WebSocketNotification{
+		Type:         "session_revoked",
+		SessionIDs:   sessionIDs,
+		RecipientIDs: []int{userID},
+	}
+}
+
+// ErrNotificationRejected means the WebSocket server refused the notification
+// itself, so sending it again cannot succeed
+var ErrNotificationRejected = errors.New("WebSocket server rejected notification")
+
+// ErrNotificationFailed means the WebSocket server answered with an error
+// status; unlike a connection failure it may be down to the notification
+var ErrNotificationFailed = errors.New("WebSocket server failed to handle notification")
+
+var notifyClient = &http.Client{Timeout: 5 * time.Second}
+
+// sendWebSocketNotification posts a signed, encoded notification to the WebSocket server
+func sendWebSocketNotification(payload []byte) error {
+	wsServerURL := getEnvOrDefault("WEBSOCKET_SERVER_URL", "http://websocket-server:8081")
+	secret := getEnvOrDefault("NOTIFY_SHARED_SECRET", "")
+	if secret == "" {
+		return fmt.Errorf("NOTIFY_SHARED_SECRET is not set")
+	}
+
+	req, err := http.NewRequest(http.MethodPost, wsServerURL+"/notify", bytes.NewBuffer(payload))
 	if err != nil {
-		log.Printf("Failed to marshal WebSocket notification: %v", err)
-		return
+		return fmt.Errorf("failed to build notification request: %v", err)
 	}
-	
+	req.Header.Set("Content-Type", "application/json")
+	if err := auth.SignRequest(req, []byte(secret), payload); err != nil {
+		return fmt.Errorf("failed to sign notification: %v", err)
+	}
+
 	// Send HTTP request to WebSocket server's notification endpoint
-	resp, err := http.Post(wsServerURL+"/notify", "application/json", bytes.NewBuffer(jsonData))
+	resp, err := notifyClient.Do(req)
 	if err != nil {
-		log.Printf("Failed to notify WebSocket server: %v", err)
-		return
+		return fmt.Errorf("failed to notify WebSocket server: %v", err)
 	}
 	defer resp.Body.Close()
-	
+
+	if resp.StatusCode == http.StatusBadRequest {
+		return fmt.Errorf("%w: status %d", ErrNotificationRejected, resp.StatusCode)
+	}
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("WebSocket server returned error status: %d", resp.StatusCode)
+		return fmt.Errorf("%w: status %d", ErrNotificationFailed, resp.StatusCode)
 	}
+	return nil
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+// ChannelMember reports whether the user has joined the channel
+func ChannelMember(db *sql.DB, channelID, userID int) (bool, error) {
+	var member bool
+	err := db.QueryRow(
+		"SELECT EXISTS(SELECT 1 FROM channel_members WHERE channel_id = ? AND user_id = ?)",
+		channelID, userID,
+	).Scan(&member)
+	return member, err
+}
+
+// Subscribe starts pushing a channel's messages to one connection. The caller
+// checks membership first.
+func (h *Hub) Subscribe(client *Client, channelID int) {
+	h.actions <- func() {
+		if !h.Clients[client] {
+			return
+		}
+		if h.channelSubs[channelID] == nil {
+			h.channelSubs[channelID] = make(map[*Client]bool)
+		}
+		h.channelSubs[channelID][client] = true
+		if client.channels == nil {
+			client.channels = make(map[int]bool)
+		}
+		client.channels[channelID] = true
+	}
+}
+
+// Unsubscribe stops pushing a channel's messages to one connection
+func (h *Hub) Unsubscribe(client *Client, channelID int) {
+	h.actions <- func() {
+		h.unsubscribe(client, channelID)
+	}
+}
+
+// UnsubscribeUsers drops every subscription the users' devices have to a
+// channel; used when they leave it
+func (h *Hub) UnsubscribeUsers(channelID int, userIDs []int) {
+	h.actions <- func() {
+		for _, userID := range userIDs {
+			for client := range h.UserClients[userID] {
+				h.unsubscribe(client, channelID)
+			}
+		}
+	}
+}
+
+// NotifyChannelMessage pushes a channel message to every subscribed
+// connection. Channel traffic is not stored for replay; clients catch up
+// through the REST API using their read pointer.
+func (h *Hub) NotifyChannelMessage(message Message) {
+	if message.ChannelID != nil {
+		h.notifyChannel("channel_message", *message.ChannelID, message)
+	}
+}
+
+// notifyChannel pushes an unsequenced event to the channel's subscribers
+func (h *Hub) notifyChannel(eventType string, channelID int, payload interface{}) {
+	data, err := json.Marshal(WebSocketMessage{Type: eventType, Data: payload})
+	if err != nil {
+		log.Printf("Failed to marshal %s frame: %v", eventType, err)
+		return
+	}
+
+	h.actions <- func() {
+		for client := range h.channelSubs[channelID] {
+			h.sendToClient(client, data)
+		}
+	}
+}
+
+// unsubscribe removes one subscription; called on the event loop
+func (h *Hub) unsubscribe(client *Client, channelID int) {
+	if subs, ok := h.channelSubs[channelID]; ok {
+		delete(subs, client)
+		if len(subs) == 0 {
+			delete(h.channelSubs, channelID)
+		}
+	}
+	delete(client.channels, channelID)
+}
+
+// handleSubscribe checks that the user has joined the channel before
+// subscribing this connection, and confirms either way
+func (c *Client) handleSubscribe(wsMsg WebSocketMessage) {
+	if wsMsg.ChannelID == nil {
+		c.reply(WebSocketMessage{Type: "error", Content: ErrChannelMissing.Error()})
+		return
+	}
+	channelID := *wsMsg.ChannelID
+
+	member, err := ChannelMember(c.Hub.DB, channelID, c.UserID)
+	if err != nil {
+		log.Printf("Failed to check channel membership for user %d: %v", c.UserID, err)
+		c.reply(WebSocketMessage{Type: "error", Content: "Failed to subscribe"})
+		return
+	}
+	if !member {
+		c.reply(WebSocketMessage{Type: "error", Content: ErrNotChannelMember.Error()})
+		return
+	}
+
+	c.Hub.Subscribe(c, channelID)
+	c.reply(WebSocketMessage{Type: "subscribed", Data: ChannelSubscription{ChannelID: channelID}})
+}
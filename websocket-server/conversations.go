@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	"chatapp/messaging"
+)
+
+// ConversationKey identifies a conversation from one user's point of view
+type ConversationKey = messaging.ConversationKey
+
+// ConversationSummary is the payload of conversation_updated events; it
+// matches the entries of the web-server's GET /api/conversations
+type ConversationSummary = messaging.ConversationSummary
+
+// NotifyConversationsUpdated publishes a conversation_updated event to each
+// user with their own view of each of their changed conversations
+func (h *Hub) NotifyConversationsUpdated(keys map[int][]ConversationKey) {
+	h.notifyConversationsUpdated("", keys)
+}
+
+// notifyConversationsUpdated is NotifyConversationsUpdated for the changes
+// reported by source; see publish
+func (h *Hub) notifyConversationsUpdated(source string, keys map[int][]ConversationKey) {
+	if h.DB == nil || len(keys) == 0 {
+		return
+	}
+	views, err := messaging.LoadConversations(h.DB, keys)
+	if err != nil {
+		log.Printf("Failed to load changed conversations: %v", err)
+		return
+	}
+	for userID, conversations := range views {
+		for _, conversation := range conversations {
+			// One source can change several of a user's conversations
+			conversationSource := source
+			if source != "" {
+				conversationSource = fmt.Sprintf("%s/%s:%d", source, conversation.Type, conversation.ID)
+			}
+			h.publish(conversationSource, []int{userID}, "conversation_updated", conversation, "")
+		}
+	}
+}
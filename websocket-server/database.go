@@ -54,3 +54,10 @@ func InitDB() (*sql.DB, error) {
 
 	return db, nil
 }
+
+func getEnvOrDefault(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
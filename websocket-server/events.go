@@ -0,0 +1,236 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// maxReplayEvents caps how many missed events are replayed on reconnect. It stays
+// below the client's send buffer; clients further behind get resync_required and
+// should reload through the REST API instead.
+const maxReplayEvents = 200
+
+// storedEvent is a sequenced frame, either replayed from user_events or held
+// back for a client that is still replaying
+type storedEvent struct {
+	Seq  int64
+	Data []byte
+}
+
+// ReplayStatus is the payload of the replay_complete frame. Seq is the latest
+// sequence number the client has been sent; it should reconnect with since=Seq.
+type ReplayStatus struct {
+	Seq      int64 `json:"seq"`
+	Replayed int   `json:"replayed"`
+}
+
+// Publish stores a user-facing event for each user, stamped with a sequence
+// number, and delivers it to the users' connected devices. Events published
+// while a device is offline are replayed when it reconnects with since=<seq>.
+func (h *Hub) Publish(userIDs []int, msgType string, payload interface{}, exceptDeviceID string) {
+	h.publish("", userIDs, msgType, payload, exceptDeviceID)
+}
+
+// publish is Publish for events raised by source, which names the web-server
+// outbox entry behind them, or is empty for this server's own events. The
+// outbox delivers at least once, so an event already stored for the same
+// source is skipped.
+func (h *Hub) publish(source string, userIDs []int, msgType string, payload interface{}, exceptDeviceID string) {
+	payloadData, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Failed to marshal %s event: %v", msgType, err)
+		return
+	}
+
+	seen := make(map[int]bool, len(userIDs))
+	for _, userID := range userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		seq, err := h.storeEvent(source, userID, msgType, payloadData)
+		if err == errDuplicateEvent {
+			continue
+		}
+		if err != nil {
+			// Still deliver live; only replay is lost
+			log.Printf("Failed to store %s event for user %d: %v", msgType, userID, err)
+		}
+
+		frame, err := json.Marshal(WebSocketMessage{Type: msgType, Data: json.RawMessage(payloadData), Seq: seq})
+		if err != nil {
+			log.Printf("Failed to marshal %s frame: %v", msgType, err)
+			continue
+		}
+		h.deliver <- delivery{userIDs: []int{userID}, data: frame, seq: seq, exceptDeviceID: exceptDeviceID}
+	}
+}
+
+// errDuplicateEvent means the event was stored by an earlier delivery of the
+// same outbox entry
+var errDuplicateEvent = errors.New("event already stored")
+
+func (h *Hub) storeEvent(source string, userID int, msgType string, payload []byte) (int64, error) {
+	if h.DB == nil {
+		return 0, nil
+	}
+	// Events of one source are unique per user and type
+	var dedupeKey interface{}
+	if source != "" {
+		dedupeKey = fmt.Sprintf("%s/%d/%s", source, userID, msgType)
+	}
+	result, err := h.DB.Exec(
+		"INSERT INTO user_events (user_id, event_type, payload, dedupe_key) VALUES (?, ?, ?, ?) ON DUPLICATE KEY UPDATE id = id",
+		userID, msgType, payload, dedupeKey,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, errDuplicateEvent
+	}
+	return result.LastInsertId()
+}
+
+// Replay loads the events a reconnecting client missed and hands them to the
+// event loop, which then switches the client to live delivery. since < 0 means
+// the client has no previous sequence number and only needs the current one.
+func (h *Hub) Replay(client *Client, since int64) {
+	var events []storedEvent
+	var lastSeq int64
+	resync := false
+
+	if h.DB != nil {
+		var err error
+		if since >= 0 {
+			events, resync, err = h.loadEvents(client.UserID, since)
+			if err != nil {
+				log.Printf("Failed to load missed events for user %d: %v", client.UserID, err)
+				resync = true
+			}
+		}
+
+		err = h.DB.QueryRow("SELECT COALESCE(MAX(id), 0) FROM user_events WHERE user_id = ?", client.UserID).Scan(&lastSeq)
+		if err != nil {
+			log.Printf("Failed to load latest sequence for user %d: %v", client.UserID, err)
+		}
+	}
+
+	h.actions <- func() {
+		h.completeReplay(client, events, lastSeq, resync)
+	}
+}
+
+func (h *Hub) loadEvents(userID int, since int64) ([]storedEvent, bool, error) {
+	// Events older than the retention window are gone; a client that far
+	// behind cannot be caught up from the log
+	var oldest int64
+	err := h.DB.QueryRow("SELECT COALESCE(MIN(id), 0) FROM user_events").Scan(&oldest)
+	if err != nil {
+		return nil, false, err
+	}
+	if since > 0 && oldest > since+1 {
+		return nil, true, nil
+	}
+
+	rows, err := h.DB.Query(
+		"SELECT id, event_type, payload FROM user_events WHERE user_id = ? AND id > ? ORDER BY id LIMIT ?",
+		userID, since, maxReplayEvents+1,
+	)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var events []storedEvent
+	for rows.Next() {
+		var seq int64
+		var msgType string
+		var payload []byte
+		if err := rows.Scan(&seq, &msgType, &payload); err != nil {
+			return nil, false, err
+		}
+
+		frame, err := json.Marshal(WebSocketMessage{Type: msgType, Data: json.RawMessage(payload), Seq: seq})
+		if err != nil {
+			return nil, false, err
+		}
+		events = append(events, storedEvent{Seq: seq, Data: frame})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+
+	if len(events) > maxReplayEvents {
+		return nil, true, nil
+	}
+	return events, false, nil
+}
+
+// completeReplay sends the replayed events followed by whatever arrived live
+// while they were loading, then switches the client to live delivery.
+// Called on the hub goroutine.
+func (h *Hub) completeReplay(client *Client, events []storedEvent, lastSeq int64, resync bool) {
+	if !h.Clients[client] {
+		return
+	}
+
+	replayed := make(map[int64]bool, len(events))
+	if resync {
+		h.sendFrame(client, WebSocketMessage{Type: "resync_required"})
+	} else {
+		for _, event := range events {
+			replayed[event.Seq] = true
+			h.sendToClient(client, event.Data)
+		}
+	}
+
+	// Anything published after the registration is either in events or in the
+	// backlog, possibly both
+	for _, event := range client.backlog {
+		if !replayed[event.Seq] {
+			h.sendToClient(client, event.Data)
+		}
+		if event.Seq > lastSeq {
+			lastSeq = event.Seq
+		}
+	}
+	client.backlog = nil
+	client.replaying = false
+
+	h.sendFrame(client, WebSocketMessage{
+		Type: "replay_complete",
+		Data: ReplayStatus{Seq: lastSeq, Replayed: len(events)},
+	})
+}
+
+// sendFrame marshals and queues a frame for one connection; called on the hub goroutine
+func (h *Hub) sendFrame(client *Client, msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal %s frame: %v", msg.Type, err)
+		return
+	}
+	h.sendToClient(client, data)
+}
+
+// PruneEvents deletes events older than the retention window, forever
+func (h *Hub) PruneEvents(retention time.Duration) {
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+
+	for ; ; <-ticker.C {
+		result, err := h.DB.Exec("DELETE FROM user_events WHERE created_at < ?", time.Now().Add(-retention))
+		if err != nil {
+			log.Printf("Failed to prune user events: %v", err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n > 0 {
+			log.Printf("Pruned %d user events older than %s", n, retention)
+		}
+	}
+}
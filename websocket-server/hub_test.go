@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestClient builds a connection-less client and drains its Send channel
+// the way WritePump would, recording every frame it receives.
+func newTestClient(hub *Hub, userID int, deviceID string) (*Client, *frameRecorder) {
+	client := &Client{
+		Hub:      hub,
+		Send:     make(chan []byte, 256),
+		UserID:   userID,
+		Username: fmt.Sprintf("user%d", userID),
+		DeviceID: deviceID,
+	}
+	rec := &frameRecorder{done: make(chan struct{})}
+	go func() {
+		defer close(rec.done)
+		for data := range client.Send {
+			rec.add(data)
+		}
+	}()
+	return client, rec
+}
+
+type frameRecorder struct {
+	mu     sync.Mutex
+	frames []WebSocketMessage
+	done   chan struct{}
+}
+
+func (r *frameRecorder) add(data []byte) {
+	var msg WebSocketMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.frames = append(r.frames, msg)
+	r.mu.Unlock()
+}
+
+func (r *frameRecorder) count(msgType string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	n := 0
+	for _, f := range r.frames {
+		if f.Type == msgType {
+			n++
+		}
+	}
+	return n
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("condition not met before timeout")
+}
+
+func TestHubFansOutToEveryDevice(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	laptop, laptopRec := newTestClient(hub, 1, "laptop")
+	phone, phoneRec := newTestClient(hub, 1, "phone")
+	sender, senderRec := newTestClient(hub, 2, "desktop")
+	hub.Register <- laptop
+	hub.Register <- phone
+	hub.Register <- sender
+
+	hub.NotifyNewMessage(Message{ID: 1, SenderID: 2, Content: "hi"}, []int{1})
+
+	waitFor(t, func() bool {
+		return laptopRec.count("new_message") == 1 &&
+			phoneRec.count("new_message") == 1 &&
+			senderRec.count("new_message") == 1
+	})
+
+	if devices := hub.UserDevices(1); len(devices) != 2 {
+		t.Errorf("expected 2 devices for user 1, got %v", devices)
+	}
+}
+
+func TestHubUnregisterKeepsOtherDevices(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	laptop, laptopRec := newTestClient(hub, 1, "laptop")
+	phone, phoneRec := newTestClient(hub, 1, "phone")
+	hub.Register <- laptop
+	hub.Register <- phone
+	hub.Unregister <- laptop
+	<-laptopRec.done
+
+	hub.NotifyNewMessage(Message{ID: 1, SenderID: 2}, []int{1})
+
+	waitFor(t, func() bool { return phoneRec.count("new_message") == 1 })
+	if devices := hub.UserDevices(1); len(devices) != 1 || devices[0] != "phone" {
+		t.Errorf("expected only the phone to remain, got %v", devices)
+	}
+}
+
+func TestHubDropsSlowClient(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	// No reader on Send, so the buffer fills up
+	slow := &Client{Hub: hub, Send: make(chan []byte, 1), UserID: 1, DeviceID: "slow"}
+	hub.Register <- slow
+
+	hub.NotifyNewMessage(Message{ID: 1, SenderID: 2}, []int{1})
+	hub.NotifyNewMessage(Message{ID: 2, SenderID: 2}, []int{1})
+
+	waitFor(t, func() bool { return len(hub.UserDevices(1)) == 0 })
+}
+
+func TestHubConcurrentConnectDisconnectNotify(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	const users = 10
+	var wg sync.WaitGroup
+
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				client, rec := newTestClient(hub, i%users, fmt.Sprintf("dev-%d-%d", i, j))
+				hub.Register <- client
+				hub.SendToClient(client, []byte(`{"type":"pong"}`))
+				hub.Unregister <- client
+				<-rec.done
+			}
+		}(i)
+	}
+
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				hub.NotifyNewMessage(Message{ID: j, SenderID: i % users}, []int{(i + 1) % users, (i + 2) % users})
+				hub.UserDevices(i % users)
+			}
+		}(i)
+	}
+
+	wg.Wait()
+
+	for userID := 0; userID < users; userID++ {
+		if devices := hub.UserDevices(userID); len(devices) != 0 {
+			t.Errorf("user %d still has devices registered: %v", userID, devices)
+		}
+	}
+}
+
+func TestHubTypingIndicatorExpires(t *testing.T) {
+	saved := typingTimeout
+	typingTimeout = 50 * time.Millisecond
+	defer func() { typingTimeout = saved }()
+
+	hub := NewHub(nil)
+	go hub.Run()
+
+	recipient, rec := newTestClient(hub, 2, "phone")
+	hub.Register <- recipient
+
+	hub.StartTyping(1, "user1", 2)
+	hub.StartTyping(1, "user1", 2) // refresh must not relay a second typing_start
+
+	waitFor(t, func() bool { return rec.count("typing_stop") == 1 })
+	if n := rec.count("typing_start"); n != 1 {
+		t.Errorf("expected 1 typing_start, got %d", n)
+	}
+
+	hub.StartTyping(1, "user1", 2)
+	hub.StopTyping(1, "user1", 2)
+	waitFor(t, func() bool { return rec.count("typing_stop") == 2 })
+}
+
+func TestHubReplayHoldsBackLiveEvents(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	client, rec := newTestClient(hub, 1, "laptop")
+	client.replaying = true
+	hub.Register <- client
+
+	frame := func(seq int64) []byte {
+		data, _ := json.Marshal(WebSocketMessage{Type: "new_message", Seq: seq})
+		return data
+	}
+
+	// Live events that arrive while the replay query is running
+	hub.actions <- func() { hub.dispatch(delivery{userIDs: []int{1}, data: frame(5), seq: 5}) }
+	hub.actions <- func() { hub.dispatch(delivery{userIDs: []int{1}, data: frame(6), seq: 6}) }
+
+	// The replay query saw 4 and 5 but not 6
+	replayed := []storedEvent{{Seq: 4, Data: frame(4)}, {Seq: 5, Data: frame(5)}}
+	hub.actions <- func() { hub.completeReplay(client, replayed, 5, false) }
+
+	waitFor(t, func() bool { return rec.count("replay_complete") == 1 })
+
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	var seqs []int64
+	for _, f := range rec.frames {
+		if f.Type == "new_message" {
+			seqs = append(seqs, f.Seq)
+		}
+	}
+	if fmt.Sprint(seqs) != "[4 5 6]" {
+		t.Errorf("expected events 4, 5, 6 in order exactly once, got %v", seqs)
+	}
+	last := rec.frames[len(rec.frames)-1].Data.(map[string]interface{})
+	if last["seq"].(float64) != 6 {
+		t.Errorf("expected replay_complete to report seq 6, got %v", last["seq"])
+	}
+}
+
+func TestHubRevokeSessionsClosesOnlyThatSession(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	laptop, laptopRec := newTestClient(hub, 1, "laptop")
+	laptop.SessionID = "s1"
+	phone, phoneRec := newTestClient(hub, 1, "phone")
+	phone.SessionID = "s2"
+	hub.Register <- laptop
+	hub.Register <- phone
+
+	hub.RevokeSessions(1, []string{"s1"})
+	<-laptopRec.done
+
+	if n := laptopRec.count("session_revoked"); n != 1 {
+		t.Errorf("expected the revoked device to be told why, got %d session_revoked frames", n)
+	}
+	if devices := hub.UserDevices(1); len(devices) != 1 || devices[0] != "phone" {
+		t.Errorf("expected only the phone to remain, got %v", devices)
+	}
+	if n := phoneRec.count("session_revoked"); n != 0 {
+		t.Errorf("expected the other session to be untouched, got %d session_revoked frames", n)
+	}
+}
+
+func TestHubChannelMessagesReachOnlySubscribers(t *testing.T) {
+	hub := NewHub(nil)
+	go hub.Run()
+
+	laptop, laptopRec := newTestClient(hub, 1, "laptop")
+	phone, phoneRec := newTestClient(hub, 1, "phone")
+	other, otherRec := newTestClient(hub, 2, "desktop")
+	hub.Register <- laptop
+	hub.Register <- phone
+	hub.Register <- other
+
+	channelID := 7
+	hub.Subscribe(laptop, channelID)
+	hub.Subscribe(other, channelID)
+	hub.NotifyChannelMessage(Message{ID: 1, SenderID: 2, ChannelID: &channelID})
+
+	waitFor(t, func() bool {
+		return laptopRec.count("channel_message") == 1 && otherRec.count("channel_message") == 1
+	})
+
+	// Moderator deletions of channel messages follow the same route
+	hub.HandleNotification(Notification{Type: "message_deleted", MessageID: 1, ChannelID: channelID, RecipientIDs: []int{2}})
+	waitFor(t, func() bool {
+		return laptopRec.count("message_deleted") == 1 && otherRec.count("message_deleted") == 1
+	})
+	if n := phoneRec.count("message_deleted"); n != 0 {
+		t.Errorf("expected the unsubscribed device to miss the deletion, got %d", n)
+	}
+
+	// Leaving drops every device of the user; disconnecting drops that connection
+	hub.UnsubscribeUsers(channelID, []int{1})
+	hub.Unregister <- other
+	<-otherRec.done
+	hub.NotifyChannelMessage(Message{ID: 2, SenderID: 2, ChannelID: &channelID})
+	hub.NotifyNewMessage(Message{ID: 3, SenderID: 2}, []int{1})
+
+	waitFor(t, func() bool { return laptopRec.count("new_message") == 1 })
+	if n := laptopRec.count("channel_message"); n != 1 {
+		t.Errorf("expected no channel messages after leaving, got %d", n)
+	}
+	if n := phoneRec.count("channel_message"); n != 0 {
+		t.Errorf("expected the unsubscribed device to get no channel messages, got %d", n)
+	}
+	if subs := len(hub.channelSubs); subs != 0 {
+		t.Errorf("expected no channel subscriptions left, got %d", subs)
+	}
+}
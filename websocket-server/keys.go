@@ -0,0 +1,33 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	"chatapp/auth"
+)
+
+// InitTokenVerifier loads the public keys used to verify access tokens, either
+// from JWT_KEYS_DIR or, by default, from the web-server's JWKS endpoint. Keys
+// fetched over JWKS are refreshed whenever a token names an unknown kid, so
+// rotations on the web-server need no restart here.
+func InitTokenVerifier() error {
+	if dir := os.Getenv("JWT_KEYS_DIR"); dir != "" {
+		keys, err := auth.LoadKeySet(dir, "")
+		if err != nil {
+			return err
+		}
+		tokenVerifier = keys
+		log.Printf("Loaded JWT verification keys from %s", dir)
+		return nil
+	}
+
+	jwksURL := getEnvOrDefault("JWT_JWKS_URL", "http://web-server:8080/.well-known/jwks.json")
+	remote := auth.NewRemoteKeySet(jwksURL)
+	if err := remote.Refresh(true); err != nil {
+		// The web-server may still be starting; keys are fetched on first use
+		log.Printf("Could not fetch JWKS from %s yet: %v", jwksURL, err)
+	}
+	tokenVerifier = remote
+	return nil
+}
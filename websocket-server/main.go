@@ -4,7 +4,9 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
+	"chatapp/auth"
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 )
@@ -16,10 +18,24 @@ func main() {
 	}
 	defer db.Close()
 
+	if err := ResetPresence(db); err != nil {
+		log.Printf("Failed to reset presence: %v", err)
+	}
+
+	if err := InitTokenVerifier(); err != nil {
+		log.Fatal("Failed to load JWT verification keys:", err)
+	}
+
 	// Initialize hub
 	hub := NewHub(db)
 	go hub.Run()
 
+	retention, err := time.ParseDuration(getEnvOrDefault("EVENT_RETENTION", "72h"))
+	if err != nil {
+		log.Fatal("Invalid EVENT_RETENTION:", err)
+	}
+	go hub.PruneEvents(retention)
+
 	r := gin.Default()
 
 	config := cors.DefaultConfig()
@@ -34,21 +50,24 @@ func main() {
 		HandleWebSocket(hub, c.Writer, c.Request)
 	})
 
-	// Notification endpoint for REST API to notify about new messages
-	r.POST("/notify", func(c *gin.Context) {
-		var notification struct {
-			Type         string  `json:"type"`
-			Message      Message `json:"message"`
-			RecipientIDs []int   `json:"recipient_ids"`
-		}
+	// Notifications must be signed by the web-server with the shared secret
+	notifySecret := os.Getenv("NOTIFY_SHARED_SECRET")
+	if notifySecret == "" {
+		log.Fatal("NOTIFY_SHARED_SECRET must be set")
+	}
+	notifyAuth := auth.NewNotifyAuthenticator(notifySecret)
 
+	// Notification endpoint for REST API to notify about new messages
+	r.POST("/notify", notifyMiddleware(notifyAuth), func(c *gin.Context) {
+		var notification Notification
 		if err := c.ShouldBindJSON(&notification); err != nil {
 			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
 			return
 		}
 
-		if notification.Type == "new_message" {
-			hub.NotifyNewMessage(notification.Message, notification.RecipientIDs)
+		if err := hub.HandleNotification(notification); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
 		}
 
 		c.JSON(http.StatusOK, gin.H{"status": "notification sent"})
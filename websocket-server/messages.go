@@ -0,0 +1,57 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+
+	"chatapp/messaging"
+)
+
+// SendMessageRequest is the payload of a send_message frame
+type SendMessageRequest = messaging.SendRequest
+
+var (
+	ErrChannelMissing   = messaging.ErrChannelMissing
+	ErrNotChannelMember = messaging.ErrNotChannelMember
+	ErrSendFailed       = errors.New("Failed to send message")
+)
+
+// verifiedOnly lists the actions REQUIRE_VERIFIED_FOR holds back from accounts
+// whose email is unverified, read the same way as on the web-server
+var verifiedOnly = messaging.ParseVerifiedOnly(getEnvOrDefault("REQUIRE_VERIFIED_FOR", "broadcast,media"))
+
+// CreateMessage checks and stores a message with the same rules as the
+// web-server's POST /api/messages, returning the stored message and the IDs
+// of the users it should be delivered to.
+func CreateMessage(db *sql.DB, senderID int, req SendMessageRequest) (Message, []int, error) {
+	if err := req.Validate(); err != nil {
+		return Message{}, nil, err
+	}
+	if err := messaging.Authorize(db, senderID, req, verifiedOnly); err != nil {
+		if messaging.Rejected(err) {
+			return Message{}, nil, err
+		}
+		log.Printf("Failed to authorize message from user %d: %v", senderID, err)
+		return Message{}, nil, ErrSendFailed
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("Failed to start transaction: %v", err)
+		return Message{}, nil, ErrSendFailed
+	}
+	defer tx.Rollback()
+
+	message, recipientIDs, err := messaging.Send(tx, senderID, req)
+	if err != nil {
+		log.Printf("Failed to send message from user %d: %v", senderID, err)
+		return Message{}, nil, ErrSendFailed
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("Failed to commit message: %v", err)
+		return Message{}, nil, ErrSendFailed
+	}
+
+	return message, recipientIDs, nil
+}
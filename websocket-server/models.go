@@ -2,24 +2,83 @@ package main
 
 import (
 	"time"
+
+	"chatapp/messaging"
 )
 
-type Message struct {
-	ID             int       `json:"id"`
-	SenderID       int       `json:"sender_id"`
-	Content        string    `json:"content"`
-	MessageType    string    `json:"message_type"`
-	MediaURL       *string   `json:"media_url"`
-	MediaType      *string   `json:"media_type"`
-	CreatedAt      time.Time `json:"created_at"`
-	SenderUsername string    `json:"sender_username"`
-}
+type Message = messaging.Message
 
 type WebSocketMessage struct {
 	Type        string      `json:"type"`
 	RecipientID int         `json:"recipient_id,omitempty"`
 	Content     string      `json:"content,omitempty"`
 	Data        interface{} `json:"data,omitempty"`
+	Seq         int64       `json:"seq,omitempty"` // Per-user sequence number of published events
+
+	// send_message fields; TempID is generated by the client and echoed back
+	// in the message_sent acknowledgement or error frame
+	TempID      string  `json:"temp_id,omitempty"`
+	MessageType string  `json:"message_type,omitempty"`
+	Recipients  []int   `json:"recipients,omitempty"`
+	MediaURL    *string `json:"media_url,omitempty"`
+	MediaType   *string `json:"media_type,omitempty"`
+	// ConversationID addresses a "group" message
+	ConversationID *int `json:"conversation_id,omitempty"`
+	// ChannelID addresses a "channel" message; also used by subscribe and unsubscribe frames
+	ChannelID *int `json:"channel_id,omitempty"`
+
+	// presence frames: "online" or "away"
+	Status string `json:"status,omitempty"`
+
+	// mark_read and ack frames
+	MessageIDs []int `json:"message_ids,omitempty"`
+}
+
+// ChannelSubscription is the payload of the subscribed and unsubscribed frames
+type ChannelSubscription struct {
+	ChannelID int `json:"channel_id"`
+}
+
+// TypingEvent is the payload of relayed typing_start / typing_stop frames
+type TypingEvent struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
+// MessageDeletedEvent is the payload of message_deleted frames
+type MessageDeletedEvent struct {
+	MessageID int `json:"message_id"`
+}
+
+// PresenceEvent is the payload of presence_changed frames
+type PresenceEvent struct {
+	UserID     int       `json:"user_id"`
+	Status     string    `json:"status"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+}
+
+// ReadReceipt is the payload of message_read frames, sent to the original
+// sender and to the reader's other devices
+type ReadReceipt struct {
+	ReaderID   int       `json:"reader_id"`
+	MessageIDs []int     `json:"message_ids"`
+	ReadAt     time.Time `json:"read_at"`
+	DeviceID   string    `json:"device_id,omitempty"` // Device the messages were read on, if known
+}
+
+// Message lifecycle after "sent", which the sender learns from message_sent or new_message
+const (
+	StatusDelivered = "delivered"
+	StatusRead      = "read"
+)
+
+// MessageStatusEvent is the payload of message_status frames, telling a sender
+// how far their messages have progressed for one recipient
+type MessageStatusEvent struct {
+	RecipientID int       `json:"recipient_id"`
+	MessageIDs  []int     `json:"message_ids"`
+	Status      string    `json:"status"`
+	At          time.Time `json:"at"`
 }
 
 type User struct {
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+)
+
+var ErrReceiptRequired = errors.New("Receipt required")
+
+// Notification is a change the web-server reports through /notify. OutboxID is
+// the outbox entry it was sent from; the outbox retries until a delivery is
+// acknowledged, so the same entry may arrive more than once.
+type Notification struct {
+	Type         string          `json:"type"`
+	OutboxID     int64           `json:"outbox_id"`
+	Message      Message         `json:"message"`
+	Receipt      *ReadReceipt    `json:"receipt"`
+	MessageID    int             `json:"message_id"`
+	Group        json.RawMessage `json:"group"`
+	ChannelID    int             `json:"channel_id"`
+	SessionIDs   []string        `json:"session_ids"`
+	RecipientIDs []int           `json:"recipient_ids"`
+	// Conversations lists, per user, the conversations whose last message or
+	// unread count changed
+	Conversations map[int][]ConversationKey `json:"conversations"`
+}
+
+// HandleNotification delivers a notification to the users it concerns. Events
+// are stored under the notification's outbox entry, so a retried notification
+// is neither stored nor sent twice.
+func (h *Hub) HandleNotification(n Notification) error {
+	var source string
+	if n.OutboxID > 0 {
+		source = strconv.FormatInt(n.OutboxID, 10)
+	}
+
+	switch n.Type {
+	case "new_message":
+		if n.Message.ChannelID != nil {
+			h.NotifyChannelMessage(n.Message)
+		} else {
+			h.notifyNewMessage(source, n.Message, n.RecipientIDs)
+		}
+	case "message_read":
+		if n.Receipt == nil {
+			return ErrReceiptRequired
+		}
+		for _, senderID := range n.RecipientIDs {
+			h.notifyMessageRead(source, senderID, *n.Receipt)
+		}
+	case "group_updated":
+		// Sent to members and to anyone just removed, who use it to drop the
+		// group from their list
+		h.publish(source, n.RecipientIDs, "group_updated", n.Group, "")
+	case "conversations_changed":
+		// Loaded here rather than by the web-server, outside its transaction
+		h.notifyConversationsUpdated(source, n.Conversations)
+	case "channel_left":
+		h.UnsubscribeUsers(n.ChannelID, n.RecipientIDs)
+	case "message_edited":
+		// Channel messages go to the channel's subscribers instead of recipients
+		if n.Message.ChannelID != nil {
+			h.notifyChannel("message_edited", *n.Message.ChannelID, n.Message)
+		} else {
+			h.publish(source, n.RecipientIDs, "message_edited", n.Message, "")
+		}
+	case "message_deleted":
+		event := MessageDeletedEvent{MessageID: n.MessageID}
+		if n.ChannelID != 0 {
+			h.notifyChannel("message_deleted", n.ChannelID, event)
+		} else {
+			h.publish(source, n.RecipientIDs, "message_deleted", event, "")
+		}
+	case "session_revoked":
+		for _, userID := range n.RecipientIDs {
+			h.RevokeSessions(userID, n.SessionIDs)
+		}
+	}
+	return nil
+}
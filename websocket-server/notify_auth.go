@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+
+	"chatapp/auth"
+	"github.com/gin-gonic/gin"
+)
+
+// notifyMiddleware rejects /notify requests that are unsigned, stale,
+// tampered with or replayed. The signature is checked by the auth module,
+// which the web-server signs with.
+func notifyMiddleware(a *auth.NotifyAuthenticator) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+		err = a.Verify(
+			c.GetHeader(auth.TimestampHeader),
+			c.GetHeader(auth.NonceHeader),
+			c.GetHeader(auth.SignatureHeader),
+			body,
+		)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized: " + err.Error()})
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	PresenceOnline  = "online"
+	PresenceAway    = "away"
+	PresenceOffline = "offline"
+)
+
+// presenceQueue is an unbounded FIFO between the hub goroutine and the presence
+// worker, so the event loop never blocks on database writes
+type presenceQueue struct {
+	mu      sync.Mutex
+	pending []PresenceEvent
+	wake    chan struct{}
+}
+
+func newPresenceQueue() *presenceQueue {
+	return &presenceQueue{wake: make(chan struct{}, 1)}
+}
+
+func (q *presenceQueue) push(event PresenceEvent) {
+	q.mu.Lock()
+	q.pending = append(q.pending, event)
+	q.mu.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (q *presenceQueue) drain() []PresenceEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	events := q.pending
+	q.pending = nil
+	return events
+}
+
+// ResetPresence marks every user offline; connections do not survive a restart
+func ResetPresence(db *sql.DB) error {
+	_, err := db.Exec("UPDATE users SET presence_status = 'offline' WHERE presence_status <> 'offline'")
+	return err
+}
+
+// SetAway records whether a device is idle and republishes the user's status
+func (h *Hub) SetAway(client *Client, away bool) {
+	h.actions <- func() {
+		if !h.Clients[client] || client.Away == away {
+			return
+		}
+		client.Away = away
+		h.updatePresence(client.UserID)
+	}
+}
+
+// updatePresence derives a user's status from their devices and queues a
+// presence_changed event if it differs from the last one published.
+// Called on the hub goroutine.
+func (h *Hub) updatePresence(userID int) {
+	status := PresenceOffline
+	if devices := h.UserClients[userID]; len(devices) > 0 {
+		status = PresenceAway
+		for client := range devices {
+			if !client.Away {
+				status = PresenceOnline
+				break
+			}
+		}
+	}
+
+	previous, ok := h.presence[userID]
+	if !ok {
+		previous = PresenceOffline
+	}
+	if status == previous {
+		return
+	}
+
+	if status == PresenceOffline {
+		delete(h.presence, userID)
+	} else {
+		h.presence[userID] = status
+	}
+
+	h.presenceQueue.push(PresenceEvent{UserID: userID, Status: status, LastSeenAt: time.Now()})
+}
+
+// runPresence persists status changes in order and pushes them to each user's contacts
+func (h *Hub) runPresence() {
+	for range h.presenceQueue.wake {
+		for _, event := range h.presenceQueue.drain() {
+			h.publishPresence(event)
+		}
+	}
+}
+
+func (h *Hub) publishPresence(event PresenceEvent) {
+	if h.DB == nil {
+		return
+	}
+
+	_, err := h.DB.Exec(
+		"UPDATE users SET presence_status = ?, last_seen_at = ? WHERE id = ?",
+		event.Status, event.LastSeenAt, event.UserID,
+	)
+	if err != nil {
+		log.Printf("Failed to persist presence for user %d: %v", event.UserID, err)
+	}
+
+	contactIDs, err := h.contactIDs(event.UserID)
+	if err != nil {
+		log.Printf("Failed to load contacts for user %d: %v", event.UserID, err)
+		return
+	}
+	if len(contactIDs) == 0 {
+		return
+	}
+
+	data, err := json.Marshal(WebSocketMessage{Type: "presence_changed", Data: event})
+	if err != nil {
+		log.Printf("Failed to marshal presence_changed frame: %v", err)
+		return
+	}
+	h.SendToUsers(contactIDs, data, "")
+}
+
+// contactIDs returns every user that has exchanged direct messages with userID
+func (h *Hub) contactIDs(userID int) ([]int, error) {
+	rows, err := h.DB.Query(`
+		SELECT DISTINCT CASE WHEN m.sender_id = ? THEN mr.recipient_id ELSE m.sender_id END
+		FROM messages m
+		JOIN message_recipients mr ON m.id = mr.message_id
+		WHERE m.message_type = 'direct' AND (m.sender_id = ? OR mr.recipient_id = ?)
+	`, userID, userID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var contactIDs []int
+	for rows.Next() {
+		var contactID int
+		if err := rows.Scan(&contactID); err == nil && contactID != userID {
+			contactIDs = append(contactIDs, contactID)
+		}
+	}
+	return contactIDs, rows.Err()
+}
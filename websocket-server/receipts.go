@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"time"
+
+	"chatapp/messaging"
+)
+
+// MarkRead flags the given messages as read by userID with the same rules as
+// the web-server's PUT /api/messages/read
+func MarkRead(db *sql.DB, userID int, messageIDs []int) (messaging.Receipts, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return messaging.Receipts{}, err
+	}
+	defer tx.Rollback()
+
+	receipts, err := messaging.MarkRead(tx, userID, messageIDs)
+	if err != nil {
+		return receipts, err
+	}
+	return receipts, tx.Commit()
+}
+
+// MarkDelivered records that userID's device received the given messages and
+// returns, per sender, the IDs of the messages that were not yet delivered
+func MarkDelivered(db *sql.DB, userID int, messageIDs []int) (map[int][]int, time.Time, error) {
+	deliveredAt := time.Now()
+	bySender := make(map[int][]int)
+	if len(messageIDs) == 0 {
+		return bySender, deliveredAt, nil
+	}
+
+	placeholders := strings.Repeat("?,", len(messageIDs)-1) + "?"
+	args := []interface{}{userID}
+	for _, id := range messageIDs {
+		args = append(args, id)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, deliveredAt, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		SELECT mr.message_id, m.sender_id
+		FROM message_recipients mr
+		JOIN messages m ON mr.message_id = m.id
+		WHERE mr.recipient_id = ? AND mr.delivered_at IS NULL AND mr.message_id IN (`+placeholders+`)
+		FOR UPDATE
+	`, args...)
+	if err != nil {
+		return nil, deliveredAt, err
+	}
+	for rows.Next() {
+		var messageID, senderID int
+		if err := rows.Scan(&messageID, &senderID); err == nil {
+			bySender[senderID] = append(bySender[senderID], messageID)
+		}
+	}
+	rows.Close()
+
+	_, err = tx.Exec(`UPDATE message_recipients
+		SET delivered_at = ?
+		WHERE recipient_id = ? AND delivered_at IS NULL AND message_id IN (`+placeholders+`)`,
+		append([]interface{}{deliveredAt}, args...)...)
+	if err != nil {
+		return nil, deliveredAt, err
+	}
+
+	return bySender, deliveredAt, tx.Commit()
+}
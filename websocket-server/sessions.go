@@ -0,0 +1,51 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+)
+
+// SessionActive reports whether the login session an access token was issued
+// for is still live. Revoked sessions are refused at connect time; sockets
+// already open are closed by RevokeSessions.
+func SessionActive(db *sql.DB, sessionID string) (bool, error) {
+	if sessionID == "" {
+		return false, nil
+	}
+	var active bool
+	err := db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM sessions
+			WHERE family_id = ? AND revoked_at IS NULL AND expires_at > NOW()
+		)
+	`, sessionID).Scan(&active)
+	return active, err
+}
+
+// RevokeSessions closes the user's connections that were opened with one of
+// sessionIDs, telling each of them why first
+func (h *Hub) RevokeSessions(userID int, sessionIDs []string) {
+	revoked := make(map[string]bool, len(sessionIDs))
+	for _, id := range sessionIDs {
+		revoked[id] = true
+	}
+
+	data, err := json.Marshal(WebSocketMessage{Type: "session_revoked"})
+	if err != nil {
+		return
+	}
+
+	h.actions <- func() {
+		for client := range h.UserClients[userID] {
+			if !revoked[client.SessionID] {
+				continue
+			}
+			h.sendToClient(client, data)
+			if h.Clients[client] {
+				h.removeClient(client)
+				log.Printf("Closed WebSocket for user %d device %s: session revoked", client.UserID, client.DeviceID)
+			}
+		}
+	}
+}
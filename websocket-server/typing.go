@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// typingTimeout is how long a typing indicator lasts if the client never sends typing_stop.
+// Clients should resend typing_start while the user keeps typing.
+var typingTimeout = 6 * time.Second
+
+type typingKey struct {
+	FromID int
+	ToID   int
+}
+
+// StartTyping relays a typing_start frame to the recipient's devices and (re)arms its expiry
+func (h *Hub) StartTyping(fromID int, username string, toID int) {
+	if toID == 0 || toID == fromID {
+		return
+	}
+
+	h.actions <- func() {
+		key := typingKey{FromID: fromID, ToID: toID}
+		if timer, ok := h.typing[key]; ok {
+			timer.Stop()
+		} else {
+			h.relayTyping("typing_start", key, username)
+		}
+
+		var timer *time.Timer
+		timer = time.AfterFunc(typingTimeout, func() {
+			h.actions <- func() {
+				// Ignore timers that were replaced by a newer typing_start
+				if h.typing[key] == timer {
+					delete(h.typing, key)
+					h.relayTyping("typing_stop", key, username)
+				}
+			}
+		})
+		h.typing[key] = timer
+	}
+}
+
+// StopTyping relays a typing_stop frame if the sender was marked as typing
+func (h *Hub) StopTyping(fromID int, username string, toID int) {
+	h.actions <- func() {
+		key := typingKey{FromID: fromID, ToID: toID}
+		if timer, ok := h.typing[key]; ok {
+			timer.Stop()
+			delete(h.typing, key)
+			h.relayTyping("typing_stop", key, username)
+		}
+	}
+}
+
+// clearTyping stops every indicator a user has open; called on the event loop
+// when the user's last device disconnects
+func (h *Hub) clearTyping(userID int) {
+	for key, timer := range h.typing {
+		if key.FromID == userID {
+			timer.Stop()
+			delete(h.typing, key)
+			h.relayTyping("typing_stop", key, "")
+		}
+	}
+}
+
+// relayTyping sends a typing frame to the recipient's devices; called on the event loop
+func (h *Hub) relayTyping(msgType string, key typingKey, username string) {
+	data, err := json.Marshal(WebSocketMessage{
+		Type: msgType,
+		Data: TypingEvent{UserID: key.FromID, Username: username},
+	})
+	if err != nil {
+		log.Printf("Failed to marshal %s frame: %v", msgType, err)
+		return
+	}
+	h.dispatch(delivery{userIDs: []int{key.ToID}, data: data})
+}
@@ -1,15 +1,23 @@
 package main
 
 import (
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"log"
 	"net/http"
+	"strconv"
 	"time"
-	"github.com/golang-jwt/jwt/v5"
+
+	"chatapp/auth"
+	"chatapp/messaging"
 	"github.com/gorilla/websocket"
 )
 
+// maxMessageSize bounds inbound frames; send_message frames carry full message content
+const maxMessageSize = 64 * 1024
+
 var upgrader = websocket.Upgrader{
 	CheckOrigin: func(r *http.Request) bool {
 		return true // Allow all origins for development
@@ -17,11 +25,21 @@ var upgrader = websocket.Upgrader{
 }
 
 type Client struct {
-	Hub      *Hub
-	Conn     *websocket.Conn
-	Send     chan []byte
-	UserID   int
-	Username string
+	Hub       *Hub
+	Conn      *websocket.Conn
+	Send      chan []byte
+	UserID    int
+	Username  string
+	DeviceID  string // Identifies this connection among the user's devices
+	SessionID string // Login session of the token the connection was opened with
+	Away      bool   // Set by the client's presence frames; only touched on the hub goroutine
+
+	// While replaying missed events, sequenced live events are held in backlog
+	// so they are not delivered ahead of older ones. Only touched on the hub goroutine.
+	replaying bool
+	backlog   []storedEvent
+
+	channels map[int]bool // Channels this connection is subscribed to; only touched on the hub goroutine
 }
 
 type Hub struct {
@@ -29,17 +47,33 @@ type Hub struct {
 	Broadcast   chan []byte
 	Register    chan *Client
 	Unregister  chan *Client
-	UserClients map[int]*Client // Map user ID to client for direct messaging
+	UserClients map[int]map[*Client]bool // Map user ID to every connected device
 	DB          *sql.DB
+
+	channelSubs map[int]map[*Client]bool // Connections subscribed to each channel
+
+	// All reads and writes of the maps above happen on the Run goroutine;
+	// other goroutines hand work to it through these channels.
+	deliver chan delivery
+	actions chan func()
+
+	typing map[typingKey]*time.Timer // Active typing indicators and their expiry timers
+
+	presence      map[int]string // Last published status of every user that is not offline
+	presenceQueue *presenceQueue
 }
 
-type Claims struct {
-	UserID   int    `json:"user_id"`
-	Username string `json:"username"`
-	jwt.RegisteredClaims
+// delivery is a payload queued for the event loop to hand to connected clients
+type delivery struct {
+	userIDs        []int   // deliver to every device of these users
+	client         *Client // or to this single connection
+	data           []byte
+	seq            int64 // set for published events, see Publish
+	exceptDeviceID string
 }
 
-var jwtSecret = []byte("your-secret-key-change-this-in-production")
+// tokenVerifier checks access tokens issued by the web-server
+var tokenVerifier auth.Verifier
 
 func NewHub(db *sql.DB) *Hub {
 	return &Hub{
@@ -47,74 +81,168 @@ func NewHub(db *sql.DB) *Hub {
 		Broadcast:   make(chan []byte),
 		Register:    make(chan *Client),
 		Unregister:  make(chan *Client),
-		UserClients: make(map[int]*Client),
+		UserClients: make(map[int]map[*Client]bool),
 		DB:          db,
+		channelSubs: make(map[int]map[*Client]bool),
+		deliver:     make(chan delivery, 1024),
+		actions:     make(chan func()),
+		typing:      make(map[typingKey]*time.Timer),
+
+		presence:      make(map[int]string),
+		presenceQueue: newPresenceQueue(),
 	}
 }
 
 func (h *Hub) Run() {
+	go h.runPresence()
+
 	for {
 		select {
 		case client := <-h.Register:
 			h.Clients[client] = true
-			h.UserClients[client.UserID] = client
-			log.Printf("User %s (ID: %d) connected via WebSocket", client.Username, client.UserID)
+			if h.UserClients[client.UserID] == nil {
+				h.UserClients[client.UserID] = make(map[*Client]bool)
+			}
+			h.UserClients[client.UserID][client] = true
+			h.updatePresence(client.UserID)
+			log.Printf("User %s (ID: %d) connected via WebSocket on device %s (%d active)",
+				client.Username, client.UserID, client.DeviceID, len(h.UserClients[client.UserID]))
 
 		case client := <-h.Unregister:
 			if _, ok := h.Clients[client]; ok {
-				delete(h.Clients, client)
-				delete(h.UserClients, client.UserID)
-				close(client.Send)
-				log.Printf("User %s (ID: %d) disconnected from WebSocket", client.Username, client.UserID)
+				h.removeClient(client)
+				log.Printf("User %s (ID: %d) disconnected device %s from WebSocket",
+					client.Username, client.UserID, client.DeviceID)
 			}
 
 		case message := <-h.Broadcast:
 			// For broadcast messages, send to all connected clients
 			for client := range h.Clients {
-				select {
-				case client.Send <- message:
-				default:
-					close(client.Send)
-					delete(h.Clients, client)
-					delete(h.UserClients, client.UserID)
-				}
+				h.sendToClient(client, message)
 			}
+
+		case d := <-h.deliver:
+			h.dispatch(d)
+
+		case fn := <-h.actions:
+			fn()
 		}
 	}
 }
 
-// NotifyNewMessage sends a notification to specific users about a new message
-func (h *Hub) NotifyNewMessage(message Message, recipientIDs []int) {
-	wsMsg := WebSocketMessage{
-		Type: "new_message",
-		Data: message,
+// dispatch hands a queued delivery to its target connections
+func (h *Hub) dispatch(d delivery) {
+	if d.client != nil {
+		h.sendToClient(d.client, d.data)
+		return
 	}
 
-	msgData, err := json.Marshal(wsMsg)
-	if err != nil {
-		log.Printf("Failed to marshal message notification: %v", err)
+	seen := make(map[int]bool, len(d.userIDs))
+	for _, userID := range d.userIDs {
+		if seen[userID] {
+			continue
+		}
+		seen[userID] = true
+
+		for client := range h.UserClients[userID] {
+			if d.exceptDeviceID != "" && client.DeviceID == d.exceptDeviceID {
+				continue
+			}
+			if client.replaying && d.seq > 0 {
+				client.backlog = append(client.backlog, storedEvent{Seq: d.seq, Data: d.data})
+				continue
+			}
+			h.sendToClient(client, d.data)
+		}
+	}
+}
+
+// sendToClient queues data on a connection, dropping the connection if it cannot keep up
+func (h *Hub) sendToClient(client *Client, data []byte) {
+	if !h.Clients[client] {
 		return
 	}
+	select {
+	case client.Send <- data:
+	default:
+		log.Printf("Dropping slow WebSocket client for user %d device %s: send buffer full", client.UserID, client.DeviceID)
+		h.removeClient(client)
+	}
+}
 
-	// Send to specific recipients if they are connected
-	for _, recipientID := range recipientIDs {
-		if client, exists := h.UserClients[recipientID]; exists {
-			select {
-			case client.Send <- msgData:
-			default:
-				// Client's send channel is full, skip
-				log.Printf("Failed to send message notification to user %d: channel full", recipientID)
-			}
+// removeClient drops a single device connection, leaving the user's other devices registered
+func (h *Hub) removeClient(client *Client) {
+	delete(h.Clients, client)
+	for channelID := range client.channels {
+		h.unsubscribe(client, channelID)
+	}
+	if devices, ok := h.UserClients[client.UserID]; ok {
+		delete(devices, client)
+		if len(devices) == 0 {
+			delete(h.UserClients, client.UserID)
+			h.clearTyping(client.UserID)
 		}
+		h.updatePresence(client.UserID)
 	}
+	close(client.Send)
+}
 
-	// Also send to sender if connected (for confirmation)
-	if client, exists := h.UserClients[message.SenderID]; exists {
-		select {
-		case client.Send <- msgData:
-		default:
+// SendToUsers queues data for every connected device of the given users
+func (h *Hub) SendToUsers(userIDs []int, data []byte, exceptDeviceID string) {
+	h.deliver <- delivery{userIDs: userIDs, data: data, exceptDeviceID: exceptDeviceID}
+}
+
+// SendToClient queues data for a single connection
+func (h *Hub) SendToClient(client *Client, data []byte) {
+	h.deliver <- delivery{client: client, data: data}
+}
+
+// UserDevices returns the device IDs of every connection the user currently has open
+func (h *Hub) UserDevices(userID int) []string {
+	result := make(chan []string, 1)
+	h.actions <- func() {
+		var deviceIDs []string
+		for client := range h.UserClients[userID] {
+			deviceIDs = append(deviceIDs, client.DeviceID)
 		}
+		result <- deviceIDs
 	}
+	return <-result
+}
+
+// NotifyNewMessage sends a notification to specific users about a new message
+func (h *Hub) NotifyNewMessage(message Message, recipientIDs []int) {
+	h.notifyNewMessage("", message, recipientIDs)
+}
+
+func (h *Hub) notifyNewMessage(source string, message Message, recipientIDs []int) {
+	// Send to every connected device of each recipient, and to all of the
+	// sender's devices for confirmation and cross-device sync
+	userIDs := append([]int{message.SenderID}, recipientIDs...)
+	h.publish(source, userIDs, "new_message", message, "")
+}
+
+// NotifyMessageRead tells the original sender that their messages were read,
+// and syncs the receipt to the reader's other devices
+func (h *Hub) NotifyMessageRead(senderID int, receipt ReadReceipt) {
+	h.notifyMessageRead("", senderID, receipt)
+}
+
+func (h *Hub) notifyMessageRead(source string, senderID int, receipt ReadReceipt) {
+	h.publish(source, []int{senderID}, "message_read", receipt, "")
+	h.publish(source, []int{receipt.ReaderID}, "message_read", receipt, receipt.DeviceID)
+
+	h.publish(source, []int{senderID}, "message_status", MessageStatusEvent{
+		RecipientID: receipt.ReaderID,
+		MessageIDs:  receipt.MessageIDs,
+		Status:      StatusRead,
+		At:          receipt.ReadAt,
+	}, "")
+}
+
+// NotifyMessageStatus pushes a delivery status update to the sender's devices
+func (h *Hub) NotifyMessageStatus(senderID int, event MessageStatusEvent) {
+	h.Publish([]int{senderID}, "message_status", event, "")
 }
 
 func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
@@ -126,21 +254,34 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Validate JWT token
-	token, err := jwt.ParseWithClaims(tokenString, &Claims{}, func(token *jwt.Token) (interface{}, error) {
-		return jwtSecret, nil
-	})
-
-	if err != nil || !token.Valid {
+	claims, err := tokenVerifier.Parse(tokenString)
+	if err != nil || !claims.IsAccessToken() {
 		http.Error(w, "Invalid token", http.StatusUnauthorized)
 		return
 	}
 
-	claims, ok := token.Claims.(*Claims)
-	if !ok {
-		http.Error(w, "Invalid token claims", http.StatusUnauthorized)
+	active, err := SessionActive(hub.DB, claims.SessionID)
+	if err != nil {
+		log.Printf("Failed to check session for user %d: %v", claims.UserID, err)
+		http.Error(w, "Failed to verify session", http.StatusInternalServerError)
+		return
+	}
+	if !active {
+		http.Error(w, "Session revoked", http.StatusUnauthorized)
 		return
 	}
 
+	// A reconnecting client passes the last sequence number it saw to get
+	// the events it missed replayed before live delivery resumes
+	since := int64(-1)
+	if sinceStr := r.URL.Query().Get("since"); sinceStr != "" {
+		since, err = strconv.ParseInt(sinceStr, 10, 64)
+		if err != nil || since < 0 {
+			http.Error(w, "Invalid since parameter", http.StatusBadRequest)
+			return
+		}
+	}
+
 	// Upgrade connection to WebSocket
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
@@ -148,18 +289,44 @@ func HandleWebSocket(hub *Hub, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Clients may pass a stable device_id so reconnects keep the same identity
+	deviceID := r.URL.Query().Get("device_id")
+	if deviceID == "" || len(deviceID) > 64 {
+		deviceID = newDeviceID()
+	}
+
 	client := &Client{
-		Hub:      hub,
-		Conn:     conn,
-		Send:     make(chan []byte, 256),
-		UserID:   claims.UserID,
-		Username: claims.Username,
+		Hub:       hub,
+		Conn:      conn,
+		Send:      make(chan []byte, 256),
+		UserID:    claims.UserID,
+		Username:  claims.Username,
+		DeviceID:  deviceID,
+		SessionID: claims.SessionID,
+
+		replaying: true,
 	}
 
 	client.Hub.Register <- client
 
+	// Tell the client which device ID it was assigned
+	welcome := WebSocketMessage{
+		Type: "connected",
+		Data: map[string]string{"device_id": deviceID},
+	}
+	if welcomeData, err := json.Marshal(welcome); err == nil {
+		hub.SendToClient(client, welcomeData)
+	}
+
 	go client.WritePump()
 	go client.ReadPump()
+	go hub.Replay(client, since)
+}
+
+func newDeviceID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
 func (c *Client) ReadPump() {
@@ -168,7 +335,7 @@ func (c *Client) ReadPump() {
 		c.Conn.Close()
 	}()
 
-	c.Conn.SetReadLimit(512)
+	c.Conn.SetReadLimit(maxMessageSize)
 	c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 	c.Conn.SetPongHandler(func(string) error {
 		c.Conn.SetReadDeadline(time.Now().Add(60 * time.Second))
@@ -192,17 +359,116 @@ func (c *Client) ReadPump() {
 		switch wsMsg.Type {
 		case "ping":
 			// Handle ping for connection keepalive
-			pongMsg := WebSocketMessage{Type: "pong"}
-			if pongData, err := json.Marshal(pongMsg); err == nil {
-				select {
-				case c.Send <- pongData:
-				default:
-				}
+			c.reply(WebSocketMessage{Type: "pong"})
+
+		case "send_message":
+			c.handleSendMessage(wsMsg)
+
+		case "typing_start":
+			c.Hub.StartTyping(c.UserID, c.Username, wsMsg.RecipientID)
+
+		case "typing_stop":
+			c.Hub.StopTyping(c.UserID, c.Username, wsMsg.RecipientID)
+
+		case "presence":
+			c.Hub.SetAway(c, wsMsg.Status == PresenceAway)
+
+		case "mark_read":
+			c.handleMarkRead(wsMsg)
+
+		case "ack":
+			c.handleAck(wsMsg)
+
+		case "subscribe":
+			c.handleSubscribe(wsMsg)
+
+		case "unsubscribe":
+			if wsMsg.ChannelID != nil {
+				c.Hub.Unsubscribe(c, *wsMsg.ChannelID)
+				c.reply(WebSocketMessage{Type: "unsubscribed", Data: ChannelSubscription{ChannelID: *wsMsg.ChannelID}})
 			}
 		}
 	}
 }
 
+// handleSendMessage persists a message sent over the socket, acknowledges it
+// to the sending device and fans it out to the recipients
+func (c *Client) handleSendMessage(wsMsg WebSocketMessage) {
+	req := SendMessageRequest{
+		Content:        wsMsg.Content,
+		MessageType:    wsMsg.MessageType,
+		Recipients:     wsMsg.Recipients,
+		ConversationID: wsMsg.ConversationID,
+		ChannelID:      wsMsg.ChannelID,
+		MediaURL:       wsMsg.MediaURL,
+		MediaType:      wsMsg.MediaType,
+	}
+
+	message, recipientIDs, err := CreateMessage(c.Hub.DB, c.UserID, req)
+	if err != nil {
+		c.reply(WebSocketMessage{Type: "error", TempID: wsMsg.TempID, Content: err.Error()})
+		return
+	}
+
+	c.reply(WebSocketMessage{Type: "message_sent", TempID: wsMsg.TempID, Data: message})
+	if message.ChannelID != nil {
+		c.Hub.NotifyChannelMessage(message)
+	} else {
+		c.Hub.NotifyNewMessage(message, recipientIDs)
+		c.Hub.NotifyConversationsUpdated(messaging.ConversationKeys(message, recipientIDs))
+	}
+}
+
+// handleMarkRead records read receipts and notifies the senders and the
+// reader's other devices
+func (c *Client) handleMarkRead(wsMsg WebSocketMessage) {
+	receipts, err := MarkRead(c.Hub.DB, c.UserID, wsMsg.MessageIDs)
+	if err != nil {
+		log.Printf("Failed to mark messages as read for user %d: %v", c.UserID, err)
+		c.reply(WebSocketMessage{Type: "error", Content: "Failed to mark messages as read"})
+		return
+	}
+
+	for senderID, messageIDs := range receipts.BySender {
+		c.Hub.NotifyMessageRead(senderID, ReadReceipt{
+			ReaderID:   c.UserID,
+			MessageIDs: messageIDs,
+			ReadAt:     receipts.ReadAt,
+			DeviceID:   c.DeviceID,
+		})
+	}
+	c.Hub.NotifyConversationsUpdated(map[int][]ConversationKey{c.UserID: receipts.Conversations})
+}
+
+// handleAck records that new_message frames reached this device and reports
+// the delivered status back to the senders
+func (c *Client) handleAck(wsMsg WebSocketMessage) {
+	bySender, deliveredAt, err := MarkDelivered(c.Hub.DB, c.UserID, wsMsg.MessageIDs)
+	if err != nil {
+		log.Printf("Failed to record delivery for user %d: %v", c.UserID, err)
+		return
+	}
+
+	for senderID, messageIDs := range bySender {
+		c.Hub.NotifyMessageStatus(senderID, MessageStatusEvent{
+			RecipientID: c.UserID,
+			MessageIDs:  messageIDs,
+			Status:      StatusDelivered,
+			At:          deliveredAt,
+		})
+	}
+}
+
+// reply queues a frame for this connection only
+func (c *Client) reply(msg WebSocketMessage) {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		log.Printf("Failed to marshal %s frame: %v", msg.Type, err)
+		return
+	}
+	c.Hub.SendToClient(c, data)
+}
+
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(54 * time.Second)
 	defer func() {
@@ -219,20 +485,8 @@ func (c *Client) WritePump() {
 				return
 			}
 
-			w, err := c.Conn.NextWriter(websocket.TextMessage)
-			if err != nil {
-				return
-			}
-			w.Write(message)
-
-			// Add queued messages to the current message
-			n := len(c.Send)
-			for i := 0; i < n; i++ {
-				w.Write([]byte{'\n'})
-				w.Write(<-c.Send)
-			}
-
-			if err := w.Close(); err != nil {
+			// One frame per message so each frame is a single JSON document
+			if err := c.Conn.WriteMessage(websocket.TextMessage, message); err != nil {
 				return
 			}
 